@@ -1,166 +1,6311 @@
 package main
 
 import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"container/heap"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"flag"
 	"fmt"
+	"html"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
 	"io"
+	"math"
+	"net"
 	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
 	"regexp"
+	"slices"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"text/template"
+	"time"
+	"unicode/utf8"
 )
 
 // LogEntry is a structure to hold the parsed fields of interest.
 type LogEntry struct {
-	IP          string
-	Path        string
-	StatusCode  string
-	UserAgent   string
+	// VHost is the virtual host the request was served for, empty when
+	// the log format has no vhost group.
+	VHost string `json:"vhost"`
+	IP    string `json:"ip"`
+	// Ident and User are the RFC 1413 identity and the authenticated user
+	// that CLF logs write after the IP, "-" when unknown, or empty when the
+	// log format has no such fields.
+	Ident string `json:"ident"`
+	User  string `json:"user"`
+	// Method is the request method, uppercased, e.g. "GET", or empty when
+	// the log format has no method.
+	Method string `json:"method"`
+	Path   string `json:"path"`
+	// Protocol is the protocol of the request line, e.g. "HTTP/1.1", or
+	// empty when it was not logged.
+	Protocol   string `json:"protocol"`
+	StatusCode string `json:"status"`
+	// Bytes is the response size, or -1 when the log has no size or "-".
+	Bytes int64 `json:"bytes"`
+	// Referer is the referrer, or "-" when the client sent none.
+	Referer   string `json:"referer"`
+	UserAgent string `json:"user_agent"`
+	// Timestamp is the request time, zero when missing or unparsable.
+	Timestamp time.Time `json:"timestamp,omitzero"`
+	// Duration is the request duration in microseconds, or -1 when the
+	// log format has no duration group or the field is "-".
+	Duration int64 `json:"duration_us"`
 }
 
 // ResultItem is a generic structure for storing counted items for sorting.
 type ResultItem struct {
-	Value string
-	Count int
+	Value   string  `json:"value" xml:"value"`
+	Count   int     `json:"count" xml:"count"`
+	Percent float64 `json:"percent,omitempty" xml:"percent,omitempty"`
+	// Bytes is the total response size, set when the items are ranked by
+	// bandwidth (-sort-by bytes).
+	Bytes int64 `json:"bytes,omitempty" xml:"bytes,omitempty"`
+}
+
+// categoryJSON is the JSON form of one category: its top items and the
+// total count the item percentages are relative to.
+type categoryJSON struct {
+	Total    int          `json:"total"`
+	Items    []ResultItem `json:"items"`
+	BelowMin int          `json:"below_min,omitempty"`
+}
+
+// withPercent fills in each item's share of total, in percent.
+func withPercent(items []ResultItem, total int) []ResultItem {
+	if total == 0 {
+		return items
+	}
+	for i := range items {
+		items[i].Percent = float64(items[i].Count) * 100 / float64(total)
+	}
+	return items
+}
+
+// sumCounts returns the sum of all counts in a map.
+func sumCounts(counts map[string]int) int {
+	total := 0
+	for _, v := range counts {
+		total += v
+	}
+	return total
 }
 
 // LogAnalyzer handles the entire analysis workflow.
 type LogAnalyzer struct {
-	ipCounts    map[string]int
-	pathCounts  map[string]int
+	ipCounts     map[string]int
+	pathCounts   map[string]int
 	statusCounts map[string]int
-	agentCounts map[string]int
-	// Regex for parsing a combined log format line:
-	// 1. IP Address (\S+)
-	// 2. Request Path (GET|POST|...) (\S+)
-	// 3. Status Code (\d+)
-	// 4. User Agent (.+?)
+	agentCounts  map[string]int
+	// sizeBucketCounts counts requests by response size bucket.
+	sizeBucketCounts map[string]int
+	// hostCounts counts requests by host (see entryHost).
+	hostCounts map[string]int
+	// errorPathStatus maps each path that returned 4xx/5xx responses to
+	// its counts per status code.
+	errorPathStatus map[string]map[string]int
+	// agentBytes, ipBytes and pathBytes sum response sizes per user
+	// agent, IP and path.
+	agentBytes map[string]int64
+	ipBytes    map[string]int64
+	pathBytes  map[string]int64
+	// sortByBytes ranks the items of the main reports by bytes served
+	// instead of requests, where sizes were logged.
+	sortByBytes bool
+	// bytesPerStatus sums response sizes per status code.
+	bytesPerStatus map[string]int64
+	// statusPathCounts maps each status code to its counts per path.
+	statusPathCounts map[string]map[string]int
+	// userCounts counts requests by authenticated user.
+	userCounts map[string]int
+	// refererCounts counts requests by referrer.
+	refererCounts map[string]int
+	// directPaths counts the requests sent without a referrer ("-") by
+	// path: direct hits from bookmarks, typed URLs or scripts.
+	directPaths map[string]int
+	// protocolCounts counts requests by request line protocol, and
+	// methodCounts by method.
+	protocolCounts map[string]int
+	methodCounts   map[string]int
+	// methodClassCounts counts requests by method and status class.
+	methodClassCounts map[string]map[string]int
+	// fingerprintCounts counts requests by their method, path and status
+	// code together (see fingerprint).
+	fingerprintCounts map[string]int
+	// pathDurations collects the request durations, in microseconds, of
+	// every path, for the latency percentiles. It is only filled when
+	// trackLatency is set, since it grows with the number of requests.
+	trackLatency  bool
+	pathDurations map[string][]int64
+	// Regex for parsing a combined log format line, by named group:
+	// ip: IP Address (\S+)
+	// method: Request Method (GET|POST|...), in any case
+	// path: Request Path (\S+)
+	// protocol: Request Protocol ([^\s"]+), optional
+	// status: Status Code (\d+)
+	// bytes: Response Size (\d+|-), optional
+	// referer: Referrer (-|\S+)
+	// agent: User Agent (.+?)
 	logRegex *regexp.Regexp
+	// formats are tried in order for lines the fast parser rejects.
+	formats []logFormat
+	// fastParse enables splitParse ahead of formats. It only understands
+	// the combined format, so it is turned off for a custom regex.
+	fastParse bool
+	// w3c parses W3C extended (IIS) lines with the columns of the last
+	// #Fields: directive seen, nil before any.
+	w3c *w3cFormat
+	// formatCounts counts matched lines per format name.
+	formatCounts map[string]int
+	// explainOut, if set, receives a dump of the parse result of the first
+	// explainLines lines (all lines when explainLines is 0).
+	explainOut   io.Writer
+	explainLines int
+	// mu guards the counts, so reports can be written while new lines
+	// are analyzed, as a watch loop does: analyze and Merge hold it for
+	// writing, and printReports and Report for reading.
+	mu sync.RWMutex
+	// stop asks analyze to return early; partial records that it did.
+	stop    atomic.Bool
+	partial bool
+	// anonymizeIPs masks client addresses right after parsing, so every
+	// IP-based count is per subnet rather than per address.
+	anonymizeIPs bool
+	// sensitivePatterns are the path fragments flagged as probes of
+	// sensitive or admin paths; sensitiveHits maps each flagged path to
+	// its counts per client IP.
+	sensitivePatterns []string
+	sensitiveHits     map[string]map[string]int
+	// traversalHits maps each raw path containing a ".." segment (see
+	// isTraversal) to its counts per client IP.
+	traversalHits map[string]map[string]int
+	// entryOut, if set, receives every parsed entry as a line of JSON,
+	// with its line number if entryLines is set; entryErr keeps the first
+	// write error.
+	entryOut   *json.Encoder
+	entryLines bool
+	entryErr   error
+	// maxCardinality bounds the number of keys in each count map (0 for no
+	// limit); overflowed records which maps reached it.
+	maxCardinality int
+	overflowed     map[string]bool
+	// healthPaths and monitorIPs select the health check and monitoring
+	// requests (see isProbe); realIPs, realPaths and realStatus count all
+	// other requests, for the real traffic summary.
+	healthPaths                    map[string]bool
+	monitorIPs                     []netip.Prefix
+	realIPs, realPaths, realStatus map[string]int
+	// securityWhitelist holds known-good addresses, such as monitoring
+	// and CI hosts, that are left out of the security reports (sensitive
+	// paths, traversal probes, auth failures, malformed requests and the
+	// scanner and rotating agent heuristics) but still counted everywhere
+	// else.
+	securityWhitelist []netip.Prefix
+	// malformed counts the lines with an invalid request line (see
+	// parseMalformed); malformedIPs, malformedReasons and malformedStatus
+	// count them by client IP, malformedReason and status code, and
+	// malformedLines maps each raw request line to its counts per IP.
+	malformed        int
+	malformedIPs     map[string]int
+	malformedReasons map[string]int
+	malformedLines   map[string]map[string]int
+	malformedStatus  map[string]int
+	// lines counts the non-empty lines read, and matched those that
+	// matched a log format, before any filter left them out.
+	lines   int
+	matched int
+	// skipped counts the lines that matched no format; skipSamples keeps
+	// the first maxSkipSamples of them, with source naming the input being
+	// analyzed. firstLine is the line number in source of the first line
+	// analyze is given, which is not 1 for a -tail sample.
+	skipped        int
+	skipSamples    []skippedLine
+	maxSkipSamples int
+	source         string
+	firstLine      int
+	// sources lists every input analyzed, as recorded in a Report.
+	sources []string
+	// excludePaths are the paths, without query string, whose requests
+	// are skipped.
+	excludePaths map[string]bool
+	// topN is the number of items per report, 0 for all.
+	topN int
+	// minRequests leaves the IPs with fewer requests out of the IP
+	// report, before taking its top items.
+	minRequests int
+	// ipTop, pathTop and agentTop, when set, count ips, paths and agents
+	// in bounded memory in place of their count maps, which analyze then
+	// refreshes from them (see syncTopTrackers).
+	ipTop, pathTop, agentTop *topTracker
+	// only, if not empty, limits the category reports to these
+	// categoryNames.
+	only map[string]bool
+	// err keeps the first error of the options given to NewLogAnalyzer.
+	err error
+	// vhostFilter, if set, restricts the analysis to requests whose
+	// entryHost is this lowercased host.
+	vhostFilter string
+	// includeStatus, if set, restricts the analysis to requests with these
+	// status codes, and excludeStatus then leaves out the requests with
+	// its codes; statusRegex, if set, must also match the status code.
+	// statusFiltered counts the requests any of them left out.
+	includeStatus, excludeStatus statusRanges
+	statusRegex                  *regexp.Regexp
+	statusFiltered               int
+	// dropEmpty leaves fields that are the "-" placeholder out of their
+	// reports instead of counting them as noneKey.
+	dropEmpty bool
+	// foldPathCase and foldAgentCase lowercase paths and user agents
+	// before counting, merging e.g. "/Index" and "/index".
+	foldPathCase, foldAgentCase bool
+	// dedupeAgents strips the version numbers of user agents before they
+	// are counted in agentCounts (see stripAgentVersions).
+	dedupeAgents bool
+	// normalizeStatus counts status codes by first digit, e.g. "404" as
+	// "4xx" (see statusFamily).
+	normalizeStatus bool
+	// joinContinuations joins the lines that do not start an entry to the
+	// entry before them (see joinContinuations).
+	joinContinuations bool
+	// syslog strips the syslog header of every line (see syslogPrefix)
+	// before it is parsed.
+	syslog bool
+	// cleanPaths canonicalizes paths with cleanPath before counting, so
+	// "/a//b" and "/a/../a/b" count as "/a/b".
+	cleanPaths bool
+	// trimTrailingSlash counts "/about/" as "/about" (see
+	// trimTrailingSlash).
+	trimTrailingSlash bool
+	// firstTime and lastTime bound the valid timestamps seen.
+	firstTime, lastTime time.Time
+	// bucketSize is the width of the time buckets used by time reports.
+	bucketSize time.Duration
+	// ipBuckets counts requests per IP per time bucket (see bucketOf). It
+	// is only filled when trackIPTimeline is set, since it grows with the
+	// number of distinct IP and bucket pairs.
+	trackIPTimeline bool
+	ipBuckets       map[string]map[int64]int
+	// ipSeen holds the first and last request time of each IP. It is only
+	// filled when trackIPSeen is set.
+	trackIPSeen bool
+	ipSeen      map[string][2]time.Time
+	// bytesBuckets sums response sizes per time bucket, and requestBuckets
+	// counts the requests.
+	bytesBuckets   map[int64]int64
+	requestBuckets map[int64]int
+	// minuteCounts counts requests per minute since the Unix epoch,
+	// whatever the bucket size.
+	minuteCounts map[int64]int
+	// hourClassCounts counts requests per hour of day, in the logged time
+	// zone, and status class.
+	hourClassCounts [24]map[string]int
+	// ipPaths holds the distinct paths requested by each IP, at most
+	// maxPathsPerIP of them. It is only filled when trackIPPaths is set.
+	trackIPPaths bool
+	ipPaths      map[string]map[string]struct{}
+	// ipAgents holds the distinct user agents sent by each IP, at most
+	// maxAgentsPerIP of them. It is only filled when trackIPAgents is set.
+	trackIPAgents bool
+	ipAgents      map[string]map[string]struct{}
+	// authFailures counts the 401 and 403 responses per IP, by status
+	// code, before any status normalization.
+	authFailures map[string]map[string]int
+	// pathTimes holds the request times of every path, as Unix
+	// nanoseconds, for -top-changes. It is only filled when trackPathTimes
+	// is set, since it grows with the number of requests.
+	trackPathTimes bool
+	pathTimes      map[string][]int64
+}
+
+// logFormat is a candidate line format. Its regex selects the LogEntry
+// fields through named capture groups, so they may appear in any order.
+type logFormat struct {
+	name  string
+	regex *regexp.Regexp
+	// Capture group index of each field, or -1 when the regex lacks it.
+	vhost, ip, ident, user, method, path, protocol, status, bytes, referer, agent, time, duration int
+}
+
+// Names of the supported log formats.
+const (
+	formatCombined = "combined"
+	formatCommon   = "common"
+	formatCustom   = "custom"
+	formatW3C      = "w3c"
+)
+
+// newLogFormat builds a logFormat from a regex with the named groups ip,
+// path and status, and optionally vhost, ident, user, method, protocol, bytes,
+// referer, agent, time and duration. Without a time group the timestamp is taken from the first
+// [...] in the line.
+func newLogFormat(name string, r *regexp.Regexp) (logFormat, error) {
+	f := logFormat{
+		name:     name,
+		regex:    r,
+		vhost:    r.SubexpIndex("vhost"),
+		ip:       r.SubexpIndex("ip"),
+		ident:    r.SubexpIndex("ident"),
+		user:     r.SubexpIndex("user"),
+		method:   r.SubexpIndex("method"),
+		path:     r.SubexpIndex("path"),
+		protocol: r.SubexpIndex("protocol"),
+		status:   r.SubexpIndex("status"),
+		bytes:    r.SubexpIndex("bytes"),
+		referer:  r.SubexpIndex("referer"),
+		agent:    r.SubexpIndex("agent"),
+		time:     r.SubexpIndex("time"),
+		duration: r.SubexpIndex("duration"),
+	}
+	if f.ip < 0 || f.path < 0 || f.status < 0 {
+		return logFormat{}, fmt.Errorf("%s regex must have named groups ip, path and status", name)
+	}
+	return f, nil
+}
+
+// mustLogFormat is like newLogFormat but panics on error. It is meant for
+// the built-in formats.
+func mustLogFormat(name string, r *regexp.Regexp) logFormat {
+	f, err := newLogFormat(name, r)
+	if err != nil {
+		panic(err)
+	}
+	return f
+}
+
+// parse matches a line against the format and extracts its fields.
+func (f logFormat) parse(line string) (LogEntry, bool) {
+	match := f.regex.FindStringSubmatch(line)
+	if match == nil {
+		return LogEntry{}, false
+	}
+
+	entry := LogEntry{
+		IP:         match[f.ip],
+		Path:       match[f.path],
+		StatusCode: match[f.status],
+		Bytes:      -1,
+		Duration:   -1,
+	}
+	if f.bytes >= 0 {
+		entry.Bytes = parseBytes(match[f.bytes])
+	}
+	if f.vhost >= 0 {
+		entry.VHost = match[f.vhost]
+	}
+	if f.ident >= 0 {
+		entry.Ident = match[f.ident]
+	}
+	if f.user >= 0 {
+		entry.User = match[f.user]
+	}
+	if f.method >= 0 {
+		entry.Method = match[f.method]
+	}
+	if f.protocol >= 0 {
+		entry.Protocol = match[f.protocol]
+	}
+	if f.referer >= 0 {
+		entry.Referer = match[f.referer]
+	}
+	if f.agent >= 0 {
+		entry.UserAgent = match[f.agent]
+	}
+	if f.time >= 0 {
+		entry.Timestamp = parseTimestamp(match[f.time])
+	} else {
+		entry.Timestamp = findTimestamp(line)
+	}
+	if f.duration >= 0 {
+		entry.Duration = parseDuration(match[f.duration])
+	}
+	return entry, true
+}
+
+// timestampLayout is the time format of the [...] field in CLF and
+// combined logs, e.g. 10/Oct/2000:13:55:36 -0700.
+const timestampLayout = "02/Jan/2006:15:04:05 -0700"
+
+// parseTimestamp parses a log timestamp, returning the zero time when it
+// is not in timestampLayout or out of range (see validTimestamp).
+func parseTimestamp(s string) time.Time {
+	t, err := time.Parse(timestampLayout, s)
+	if err != nil {
+		return time.Time{}
+	}
+	return validTimestamp(t)
+}
+
+// minTimestamp and maxTimestamp bound the timestamps that are kept, well
+// inside the years 1678 to 2262 that UnixNano can represent, so the time
+// bucket arithmetic cannot overflow.
+var (
+	minTimestamp = time.Date(1700, time.January, 1, 0, 0, 0, 0, time.UTC)
+	maxTimestamp = time.Date(2200, time.January, 1, 0, 0, 0, 0, time.UTC)
+)
+
+// validTimestamp returns t, or the zero time, which counts as no
+// timestamp, when t is before minTimestamp or not before maxTimestamp.
+func validTimestamp(t time.Time) time.Time {
+	if t.Before(minTimestamp) || !t.Before(maxTimestamp) {
+		return time.Time{}
+	}
+	return t
+}
+
+// findTimestamp parses the first bracketed field of a line as a timestamp.
+func findTimestamp(line string) time.Time {
+	start := strings.IndexByte(line, '[')
+	if start < 0 {
+		return time.Time{}
+	}
+	end := strings.IndexByte(line[start:], ']')
+	if end < 0 {
+		return time.Time{}
+	}
+	return parseTimestamp(line[start+1 : start+end])
 }
 
 const logURL = "https://gist.githubusercontent.com/kamranahmedse/e66c3b9ea89a1a030d3b739eeeef22d0/raw/77fb3ac837a73c4f0206e78a236d885590b7ae35/nginx-access.log"
 
-// NewLogAnalyzer creates and initializes the analyzer.
-func NewLogAnalyzer() *LogAnalyzer {
+// NewLogAnalyzer creates and initializes the analyzer, then applies opts
+// in order. Errors from the options are reported by Err.
+func NewLogAnalyzer(opts ...Option) *LogAnalyzer {
 	// A robust regex to capture the required fields from the combined log format.
 	// We specifically look for the request path and user agent within quotes.
-	regexString := `^(\S+).*?"(?:GET|POST|PUT|DELETE|HEAD|OPTIONS)\s(\S+).*?"\s(\d+).*?"(?:-|\S+)"\s+"(.+?)"`
+	regexString := `^(?P<ip>\S+)(?:\s(?P<ident>\S+)\s(?P<user>\S+)\s\[)?.*?"(?P<method>(?i:GET|POST|PUT|DELETE|HEAD|OPTIONS))\s(?P<path>\S+)(?:\s(?P<protocol>[^\s"]+))?.*?"\s(?P<status>\d+)(?:\s(?P<bytes>\d+|-))?.*?"(?P<referer>-|\S+)"\s+"(?P<agent>.+?)"`
 	r := regexp.MustCompile(regexString)
 
-	return &LogAnalyzer{
-		ipCounts:     make(map[string]int),
-		pathCounts:   make(map[string]int),
-		statusCounts: make(map[string]int),
-		agentCounts:  make(map[string]int),
-		logRegex:     r,
+	// The Common Log Format has no referrer or user agent after the size.
+	commonRegex := regexp.MustCompile(`^(?P<ip>\S+) (?P<ident>\S+) (?P<user>\S+) \[[^\]]*\] "(?P<method>(?i:GET|POST|PUT|DELETE|HEAD|OPTIONS))\s(?P<path>\S+)(?:\s(?P<protocol>[^\s"]+))?[^"]*" (?P<status>\d+) (?P<bytes>\S+)\s*$`)
+
+	la := &LogAnalyzer{
+		ipCounts:         make(map[string]int),
+		pathCounts:       make(map[string]int),
+		statusCounts:     make(map[string]int),
+		agentCounts:      make(map[string]int),
+		sizeBucketCounts: make(map[string]int),
+		hostCounts:       make(map[string]int),
+		errorPathStatus:  make(map[string]map[string]int),
+		agentBytes:       make(map[string]int64),
+		ipBytes:          make(map[string]int64),
+		pathBytes:        make(map[string]int64),
+		bytesPerStatus:   make(map[string]int64),
+		statusPathCounts: make(map[string]map[string]int),
+		refererCounts:    make(map[string]int),
+		directPaths:      make(map[string]int),
+		userCounts:       make(map[string]int),
+		protocolCounts:   make(map[string]int),
+		methodCounts:     make(map[string]int),
+		healthPaths:      make(map[string]bool),
+		excludePaths:     make(map[string]bool),
+		malformedIPs:     make(map[string]int),
+		malformedReasons: make(map[string]int),
+		malformedLines:   make(map[string]map[string]int),
+		malformedStatus:  make(map[string]int),
+		realIPs:          make(map[string]int),
+		realPaths:        make(map[string]int),
+		realStatus:       make(map[string]int),
+		pathDurations:    make(map[string][]int64),
+		logRegex:         r,
+		formats: []logFormat{
+			mustLogFormat(formatCombined, r),
+			mustLogFormat(formatCommon, commonRegex),
+		},
+		fastParse:         true,
+		formatCounts:      make(map[string]int),
+		bucketSize:        time.Hour,
+		ipBuckets:         make(map[string]map[int64]int),
+		ipSeen:            make(map[string][2]time.Time),
+		bytesBuckets:      make(map[int64]int64),
+		requestBuckets:    make(map[int64]int),
+		minuteCounts:      make(map[int64]int),
+		pathTimes:         make(map[string][]int64),
+		ipPaths:           make(map[string]map[string]struct{}),
+		ipAgents:          make(map[string]map[string]struct{}),
+		fingerprintCounts: make(map[string]int),
+		methodClassCounts: make(map[string]map[string]int),
+		sensitivePatterns: append([]string(nil), defaultSensitivePatterns...),
+		sensitiveHits:     make(map[string]map[string]int),
+		traversalHits:     make(map[string]map[string]int),
+		authFailures:      make(map[string]map[string]int),
+		overflowed:        make(map[string]bool),
+		topN:              5,
+	}
+	for _, opt := range opts {
+		opt(la)
 	}
+	return la
 }
 
-// downloadLogFile fetches the log content from the specified URL.
-func downloadLogFile(url string) (string, error) {
-	fmt.Printf("Downloading log file from: %s\n", url)
-	resp, err := http.Get(url)
+// Option configures a LogAnalyzer created by NewLogAnalyzer.
+type Option func(*LogAnalyzer)
+
+// WithRegex replaces the built-in formats with r, a regex with the named
+// groups described at newLogFormat.
+func WithRegex(r *regexp.Regexp) Option {
+	return func(la *LogAnalyzer) {
+		la.setErr(la.useRegex(r))
+	}
+}
+
+// WithExcludePaths leaves requests for the given paths, compared without
+// the query string, out of the analysis.
+func WithExcludePaths(paths ...string) Option {
+	return func(la *LogAnalyzer) {
+		for _, p := range paths {
+			la.excludePaths[p] = true
+		}
+	}
+}
+
+// WithTopN sets the number of items per report, 0 for all.
+func WithTopN(n int) Option {
+	return func(la *LogAnalyzer) {
+		if n < 0 {
+			la.setErr(fmt.Errorf("top N must not be negative, got %d", n))
+			return
+		}
+		la.topN = n
+	}
+}
+
+// WithIncludeStatus restricts the analysis to requests whose status code
+// is in spec, a comma separated list of codes, ranges and classes such as
+// "404,500-599,3xx".
+func WithIncludeStatus(spec string) Option {
+	return func(la *LogAnalyzer) {
+		r, err := parseStatusRanges(spec)
+		if err != nil {
+			la.setErr(fmt.Errorf("include status: %w", err))
+			return
+		}
+		la.includeStatus = r
+	}
+}
+
+// WithExcludeStatus leaves out the requests whose status code is in spec,
+// in the form WithIncludeStatus takes.
+func WithExcludeStatus(spec string) Option {
+	return func(la *LogAnalyzer) {
+		r, err := parseStatusRanges(spec)
+		if err != nil {
+			la.setErr(fmt.Errorf("exclude status: %w", err))
+			return
+		}
+		la.excludeStatus = r
+	}
+}
+
+// WithStatusRegex restricts the analysis to requests whose status code
+// matches r.
+func WithStatusRegex(r *regexp.Regexp) Option {
+	return func(la *LogAnalyzer) {
+		la.statusRegex = r
+	}
+}
+
+// WithVHost restricts the analysis to requests for host, compared without
+// case.
+func WithVHost(host string) Option {
+	return func(la *LogAnalyzer) {
+		la.vhostFilter = strings.ToLower(host)
+	}
+}
+
+// WithHealthPaths marks the requests for the given paths, compared without
+// the query string, as health checks: they are counted, but left out of
+// the real traffic summary.
+func WithHealthPaths(paths ...string) Option {
+	return func(la *LogAnalyzer) {
+		for _, p := range paths {
+			la.healthPaths[p] = true
+		}
+	}
+}
+
+// WithMonitorIPs marks the requests from the given addresses or CIDR
+// ranges as monitoring, left out of the real traffic summary like
+// WithHealthPaths.
+func WithMonitorIPs(ips ...string) Option {
+	return func(la *LogAnalyzer) {
+		prefixes, err := parsePrefixes(ips)
+		if err != nil {
+			la.setErr(fmt.Errorf("monitor IPs: %w", err))
+			return
+		}
+		la.monitorIPs = append(la.monitorIPs, prefixes...)
+	}
+}
+
+// WithIPWhitelist leaves the given addresses or CIDR ranges out of the
+// security reports and heuristics.
+func WithIPWhitelist(ips ...string) Option {
+	return func(la *LogAnalyzer) {
+		prefixes, err := parsePrefixes(ips)
+		if err != nil {
+			la.setErr(fmt.Errorf("IP whitelist: %w", err))
+			return
+		}
+		la.securityWhitelist = append(la.securityWhitelist, prefixes...)
+	}
+}
+
+// WithAnonymizeIPs masks client addresses with anonymizeIP as they are
+// parsed.
+func WithAnonymizeIPs() Option {
+	return func(la *LogAnalyzer) {
+		la.anonymizeIPs = true
+	}
+}
+
+// WithFoldCase lowercases paths, user agents or both before counting.
+func WithFoldCase(paths, agents bool) Option {
+	return func(la *LogAnalyzer) {
+		la.foldPathCase = paths
+		la.foldAgentCase = agents
+	}
+}
+
+// WithCleanPaths canonicalizes paths with cleanPath before counting.
+func WithCleanPaths() Option {
+	return func(la *LogAnalyzer) {
+		la.cleanPaths = true
+	}
+}
+
+// WithTrimTrailingSlash counts "/about/" as "/about".
+func WithTrimTrailingSlash() Option {
+	return func(la *LogAnalyzer) {
+		la.trimTrailingSlash = true
+	}
+}
+
+// WithDedupeAgents strips version numbers from user agents before they
+// are counted.
+func WithDedupeAgents() Option {
+	return func(la *LogAnalyzer) {
+		la.dedupeAgents = true
+	}
+}
+
+// WithNormalizeStatus counts status codes by class, e.g. "404" as "4xx".
+func WithNormalizeStatus() Option {
+	return func(la *LogAnalyzer) {
+		la.normalizeStatus = true
+	}
+}
+
+// WithDropEmpty leaves "-" user agents, referrers and sizes out of their
+// reports instead of counting them as noneKey.
+func WithDropEmpty() Option {
+	return func(la *LogAnalyzer) {
+		la.dropEmpty = true
+	}
+}
+
+// WithOnly limits the category reports to the given categoryNames.
+func WithOnly(categories ...string) Option {
+	return func(la *LogAnalyzer) {
+		for _, name := range categories {
+			if !slices.Contains(categoryNames, name) {
+				la.setErr(fmt.Errorf("invalid category %q (want %s)", name, strings.Join(categoryNames, ", ")))
+				return
+			}
+			if la.only == nil {
+				la.only = make(map[string]bool)
+			}
+			la.only[name] = true
+		}
+	}
+}
+
+// WithMaxCardinality bounds the number of keys in each count map, 0 for
+// no limit.
+func WithMaxCardinality(n int) Option {
+	return func(la *LogAnalyzer) {
+		if n < 0 {
+			la.setErr(fmt.Errorf("max cardinality must not be negative, got %d", n))
+			return
+		}
+		la.maxCardinality = n
+	}
+}
+
+// WithApproxTop counts IPs, paths and user agents in bounded memory,
+// keeping about n candidates each (see topTracker).
+func WithApproxTop(n int) Option {
+	return func(la *LogAnalyzer) {
+		if n <= 0 {
+			la.setErr(fmt.Errorf("approximate top size must be positive, got %d", n))
+			return
+		}
+		la.useTopTrackers(n)
+	}
+}
+
+// WithSensitivePatterns adds path fragments to flag as probes of
+// sensitive or admin paths, besides defaultSensitivePatterns.
+func WithSensitivePatterns(patterns ...string) Option {
+	return func(la *LogAnalyzer) {
+		la.sensitivePatterns = append(la.sensitivePatterns, patterns...)
+	}
+}
+
+// Err returns the first error of the options passed to NewLogAnalyzer.
+func (la *LogAnalyzer) Err() error {
+	return la.err
+}
+
+// setErr keeps err if it is the first option error.
+func (la *LogAnalyzer) setErr(err error) {
+	if la.err == nil {
+		la.err = err
+	}
+}
+
+// useRegex replaces the built-in formats with a user-supplied regex.
+// Fields are taken from its named groups (see newLogFormat), so the regex
+// can describe formats whose fields come in a different order.
+func (la *LogAnalyzer) useRegex(r *regexp.Regexp) error {
+	f, err := newLogFormat(formatCustom, r)
 	if err != nil {
-		return "", fmt.Errorf("error fetching log file: %w", err)
+		return err
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("failed to download log file. Status code: %d", resp.StatusCode)
+	la.logRegex = r
+	la.formats = []logFormat{f}
+	la.fastParse = false
+	return nil
+}
+
+// logURLs picks the log sources by precedence: -url flags, then the
+// LOG_URL environment variable, then the built-in logURL.
+func logURLs(flagURLs []string) []string {
+	if len(flagURLs) > 0 {
+		return flagURLs
+	}
+	if env := os.Getenv("LOG_URL"); env != "" {
+		return []string{env}
+	}
+	return []string{logURL}
+}
+
+// statusOut receives progress and status messages. It is stderr when a
+// machine-readable -format owns stdout.
+var statusOut io.Writer = os.Stdout
+
+// downloadLogFile fetches the log content from the specified URL.
+func downloadLogFile(ctx context.Context, url string) (string, error) {
+	fmt.Fprintf(statusOut, "Downloading log file from: %s\n", url)
+	body, err := openLogURL(ctx, url)
+	if err != nil {
+		return "", err
 	}
+	defer body.Close()
 
-	body, err := io.ReadAll(resp.Body)
+	content, err := io.ReadAll(body)
 	if err != nil {
 		return "", fmt.Errorf("error reading response body: %w", err)
 	}
 
-	return string(body), nil
+	return string(content), nil
 }
 
-// analyze processes the log content line by line.
-func (la *LogAnalyzer) analyze(logContent string) {
-	lines := strings.Split(logContent, "\n")
-	fmt.Printf("Processing %d log lines...\n", len(lines))
+// logMember is one log file of a downloaded source: the source itself, or
+// a file of a tar archive, named by its path in the archive.
+type logMember struct {
+	name, content string
+	// firstLine is the line number of the first line of content in the
+	// file, 1 unless content is a -tail sample.
+	firstLine int
+}
+
+// logMembers unpacks a downloaded source with eachLogMember.
+func logMembers(content string) ([]logMember, error) {
+	var members []logMember
+	err := eachLogMember(strings.NewReader(content), func(name string, r io.Reader) error {
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return fmt.Errorf("error reading log data: %w", err)
+		}
+		members = append(members, logMember{name: name, content: string(data), firstLine: 1})
+		return nil
+	})
+	return members, err
+}
+
+// eachLogMember unpacks a log source read from r, gunzipping it if
+// needed, and calls f with each of its log files: a tar archive yields its
+// regular text files, each gunzipped if needed, as for rotated logs
+// shipped as one .tar.gz; anything else is a single member with no name.
+// Binary members are skipped with a message. f reads as much of a member
+// as it needs before returning.
+func eachLogMember(r io.Reader, f func(name string, r io.Reader) error) error {
+	r, err := gunzipReader(r)
+	if err != nil {
+		return err
+	}
+	br := bufio.NewReader(r)
+	if start, _ := br.Peek(262); len(start) < 262 || string(start[257:]) != "ustar" {
+		return f("", br)
+	}
 
-	for _, line := range lines {
-		if line == "" {
+	tr := tar.NewReader(br)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("error reading tar archive: %w", err)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		member, err := gunzipReader(tr)
+		if err != nil {
+			return fmt.Errorf("%s: %w", hdr.Name, err)
+		}
+		mr := bufio.NewReaderSize(member, 8192)
+		if start, _ := mr.Peek(8192); bytes.IndexByte(start, 0) >= 0 {
+			fmt.Fprintf(statusOut, "Skipping %s in the archive: not a text file\n", hdr.Name)
 			continue
 		}
+		if err := f(hdr.Name, mr); err != nil {
+			return fmt.Errorf("%s: %w", hdr.Name, err)
+		}
+	}
+}
+
+// gunzipReader returns a reader of r decompressed if it is gzip data, or
+// of r unchanged.
+func gunzipReader(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	if magic, _ := br.Peek(2); string(magic) != "\x1f\x8b" {
+		return br, nil
+	}
+	zr, err := gzip.NewReader(br)
+	if err != nil {
+		return nil, fmt.Errorf("error reading gzip data: %w", err)
+	}
+	return zr, nil
+}
 
-		match := la.logRegex.FindStringSubmatch(line)
-		if len(match) == 5 {
-			// match[0] is the entire line
-			entry := LogEntry{
-				IP:         match[1],
-				Path:       match[2],
-				StatusCode: match[3],
-				UserAgent:  match[4],
+// downloadLogSample downloads only the first head lines of each log file
+// of a source, or, when tail is set instead, streams them keeping the last
+// tail lines in a ring buffer. Compressed sources and archives are
+// unpacked first, as by logMembers.
+func downloadLogSample(ctx context.Context, url string, head, tail int) ([]logMember, error) {
+	fmt.Fprintf(statusOut, "Downloading log file from: %s\n", url)
+	body, err := openLogURL(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	var members []logMember
+	err = eachLogMember(body, func(name string, r io.Reader) error {
+		content, firstLine, err := sampleLines(r, head, tail)
+		if err != nil {
+			return err
+		}
+		members = append(members, logMember{name: name, content: content, firstLine: firstLine})
+		return nil
+	})
+	return members, err
+}
+
+// sampleLines reads the first head lines of r, or the last tail lines
+// when tail is set instead, and joins them. It also returns the line
+// number of the first line kept.
+func sampleLines(r io.Reader, head, tail int) (string, int, error) {
+	var lines []string
+	ring, next := make([]string, tail), 0
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		if head > 0 {
+			lines = append(lines, scanner.Text())
+			if len(lines) == head {
+				break
 			}
+			continue
+		}
+		ring[next%tail] = scanner.Text()
+		next++
+	}
+	if err := scanner.Err(); err != nil {
+		return "", 0, fmt.Errorf("error reading response body: %w", err)
+	}
+	first := max(0, next-tail)
+	if tail > 0 {
+		for i := first; i < next; i++ {
+			lines = append(lines, ring[i%tail])
+		}
+	}
+	return strings.Join(lines, "\n"), first + 1, nil
+}
 
-			// Update counts
-			la.ipCounts[entry.IP]++
-			la.pathCounts[entry.Path]++
-			la.statusCounts[entry.StatusCode]++
-			la.agentCounts[entry.UserAgent]++
+// openS3 opens s3:// URLs. It is set by log_analyzer_s3.go, which is only
+// built with the s3 tag.
+var openS3 func(ctx context.Context, url string) (io.ReadCloser, error)
+
+// openLogURL starts downloading a log file and returns its body, which the
+// caller must close.
+func openLogURL(ctx context.Context, url string) (io.ReadCloser, error) {
+	if strings.HasPrefix(url, "s3://") {
+		if openS3 == nil {
+			return nil, fmt.Errorf("s3:// URLs need the s3 build tag: go run -tags s3 log_analyzer.go log_analyzer_s3.go")
 		}
+		return openS3(ctx, url)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching log file: %w", err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching log file: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("failed to download log file. Status code: %d", resp.StatusCode)
 	}
+	return resp.Body, nil
 }
 
-// getTopN converts a count map into a sorted slice of ResultItem and returns the top N.
-func getTopN(counts map[string]int, n int) []ResultItem {
-	var results []ResultItem
-	for val, count := range counts {
-		results = append(results, ResultItem{Value: val, Count: count})
+// dryRunLines is the number of lines -dry-run parses from each input.
+const dryRunLines = 100
+
+// dryRun parses up to maxLines non-blank lines of r, without counting
+// them, and writes the match rate, the formats matched and how many
+// matched lines had each optional field. It returns the number of lines
+// read and matched.
+func (la *LogAnalyzer) dryRun(w io.Writer, r io.Reader, maxLines int) (read, matched int, err error) {
+	formats := make(map[string]int)
+	fields := []struct {
+		name  string
+		has   func(LogEntry) bool
+		count int
+	}{
+		{name: "vhost", has: func(e LogEntry) bool { return e.VHost != "" }},
+		{name: "protocol", has: func(e LogEntry) bool { return e.Protocol != "" }},
+		{name: "bytes", has: func(e LogEntry) bool { return e.Bytes >= 0 }},
+		{name: "referer", has: func(e LogEntry) bool { return e.Referer != "" && e.Referer != "-" }},
+		{name: "user agent", has: func(e LogEntry) bool { return e.UserAgent != "" && e.UserAgent != "-" }},
+		{name: "timestamp", has: func(e LogEntry) bool { return !e.Timestamp.IsZero() }},
+		{name: "duration", has: func(e LogEntry) bool { return e.Duration >= 0 }},
 	}
 
-	// Sort the slice by count (descending)
-	sort.Slice(results, func(i, j int) bool {
-		return results[i].Count > results[j].Count
-	})
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<20)
+	for read < maxLines && scanner.Scan() {
+		line := la.cleanLine(scanner.Text())
+		if line == "" || la.directive(line) {
+			continue
+		}
+		read++
+		entry, format, ok := la.parseLine(line)
+		if !ok {
+			continue
+		}
+		matched++
+		formats[format]++
+		for i := range fields {
+			if fields[i].has(entry) {
+				fields[i].count++
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return read, matched, fmt.Errorf("error reading log file: %w", err)
+	}
 
-	if len(results) < n {
-		return results
+	pct := 0.0
+	if read > 0 {
+		pct = float64(matched) * 100 / float64(read)
+	}
+	fmt.Fprintf(w, "Matched %s of the first %s lines (%s)\n", formatInt(matched), formatInt(read), formatPercent(pct))
+	if matched == 0 {
+		return read, matched, nil
+	}
+	for _, item := range getTopN(formats, 0) {
+		fmt.Fprintf(w, "  format %s: %s lines\n", item.Value, formatInt(item.Count))
 	}
-	return results[:n]
+	fmt.Fprintln(w, "  ip, path and status: every matched line")
+	for _, f := range fields {
+		fmt.Fprintf(w, "  %s: %s of %s matched lines\n", f.name, formatInt(f.count), formatInt(matched))
+	}
+	return read, matched, nil
 }
 
-// printResults prints the top N results for a given title and slice.
-func printResults(title string, results []ResultItem) {
-	fmt.Printf("\n%s:\n", title)
-	for _, item := range results {
-		fmt.Printf("%s - %d requests\n", item.Value, item.Count)
+// Webhook delivery settings for -webhook.
+const (
+	webhookTimeout  = 10 * time.Second
+	webhookAttempts = 3
+)
+
+// alertPayload is the JSON body POSTed to -webhook when a threshold fires.
+// Condition names the -fail-on flag. Value and Threshold are in its units:
+// a 5xx percentage for fail-on-5xx-pct, percentage points for
+// fail-on-error-increase, and for fail-on-change the number of changed
+// counts against the -compare-threshold-pct percentage, with Changes
+// listing them.
+type alertPayload struct {
+	Condition     string        `json:"condition"`
+	Value         float64       `json:"value"`
+	Threshold     float64       `json:"threshold"`
+	TotalRequests int           `json:"total_requests"`
+	TopStatuses   []ResultItem  `json:"top_statuses"`
+	TopPaths      []ResultItem  `json:"top_paths"`
+	Changes       []alertChange `json:"changes,omitempty"`
+}
+
+// alertChange is one count that changed since the baseline, in a
+// fail-on-change alert.
+type alertChange struct {
+	Category string `json:"category"`
+	Value    string `json:"value"`
+	Before   int    `json:"before"`
+	After    int    `json:"after"`
+}
+
+// newAlert builds the alertPayload of a fired condition, with the top
+// status codes and paths for context.
+func (la *LogAnalyzer) newAlert(condition string, value, threshold float64) alertPayload {
+	return alertPayload{
+		Condition:     condition,
+		Value:         value,
+		Threshold:     threshold,
+		TotalRequests: la.totalRequests(),
+		TopStatuses:   getTopN(la.statusCounts, la.topN),
+		TopPaths:      getTopN(la.pathCounts, la.topN),
 	}
 }
 
-func main() {
-	// 1. Download the log file
-	logContent, err := downloadLogFile(logURL)
+// postWebhook POSTs the payload as JSON, retrying on network errors and
+// non-2xx responses with a growing delay between attempts.
+func postWebhook(target string, payload alertPayload) error {
+	body, err := json.Marshal(payload)
 	if err != nil {
-		fmt.Printf("Fatal Error: %v\n", err)
-		return
+		return fmt.Errorf("error encoding webhook payload: %w", err)
+	}
+
+	client := &http.Client{Timeout: webhookTimeout}
+	for attempt := 1; ; attempt++ {
+		var resp *http.Response
+		resp, err = client.Post(target, "application/json", bytes.NewReader(body))
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+				return nil
+			}
+			err = fmt.Errorf("status code: %d", resp.StatusCode)
+		}
+		if attempt == webhookAttempts {
+			return fmt.Errorf("error posting to webhook after %d attempts: %w", attempt, err)
+		}
+		time.Sleep(time.Duration(attempt) * time.Second)
+	}
+}
+
+// isErrorStatus reports whether a status code is a 4xx or 5xx error.
+func isErrorStatus(code string) bool {
+	return strings.HasPrefix(code, "4") || strings.HasPrefix(code, "5")
+}
+
+// summary holds the headline metrics of an analysis.
+type summary struct {
+	TotalRequests  int     `json:"total_requests" xml:"total_requests"`
+	UniqueIPs      int     `json:"unique_ips" xml:"unique_ips"`
+	UniquePaths    int     `json:"unique_paths" xml:"unique_paths"`
+	ServerErrorPct float64 `json:"server_error_pct" xml:"server_error_pct"`
+	TopPath        string  `json:"top_path" xml:"top_path"`
+	TopIP          string  `json:"top_ip" xml:"top_ip"`
+}
+
+// summary computes the headline metrics.
+func (la *LogAnalyzer) summary() summary {
+	return summaryOf(la.ipCounts, la.pathCounts, la.statusCounts)
+}
+
+// realSummary computes the headline metrics of the real traffic, that is
+// without the requests isProbe matches.
+func (la *LogAnalyzer) realSummary() summary {
+	return summaryOf(la.realIPs, la.realPaths, la.realStatus)
+}
+
+// summaryOf computes the headline metrics from per IP, path and status
+// code counts.
+func summaryOf(ips, paths, statuses map[string]int) summary {
+	s := summary{
+		TotalRequests:  sumCounts(statuses),
+		UniqueIPs:      len(ips),
+		UniquePaths:    len(paths),
+		ServerErrorPct: serverErrorShare(statuses),
+	}
+	if top := getTopN(paths, 1); len(top) > 0 {
+		s.TopPath = top[0].Value
+	}
+	if top := getTopN(ips, 1); len(top) > 0 {
+		s.TopIP = top[0].Value
+	}
+	return s
+}
+
+// compact renders the summary as a single key=value line, e.g.
+// "total=12345 unique_ips=678 5xx=1.20% top_path=/api top_ip=1.2.3.4".
+func (s summary) compact() string {
+	return s.fields("")
+}
+
+// fields renders the summary as key=value pairs, each key starting with
+// prefix.
+func (s summary) fields(prefix string) string {
+	return fmt.Sprintf("%[1]stotal=%[2]s %[1]sunique_ips=%[3]s %[1]s5xx=%[4]s %[1]stop_path=%[5]s %[1]stop_ip=%[6]s",
+		prefix, formatInt(s.TotalRequests), formatInt(s.UniqueIPs), formatPercent(s.ServerErrorPct), s.TopPath, s.TopIP)
+}
+
+// fprintProbeSummary writes the raw and real traffic headline metrics side
+// by side, with the share of each that is probe traffic.
+func fprintProbeSummary(w io.Writer, all, realTraffic summary) {
+	probes := all.TotalRequests - realTraffic.TotalRequests
+	probePct := 0.0
+	if all.TotalRequests > 0 {
+		probePct = float64(probes) * 100 / float64(all.TotalRequests)
 	}
 
-	// 2. Initialize and run analysis
-	analyzer := NewLogAnalyzer()
-	analyzer.analyze(logContent)
+	fmt.Fprintln(w, "\nSummary:")
+	fmt.Fprintf(w, "%-14s %14s %14s\n", "", "all traffic", "real traffic")
+	fmt.Fprintf(w, "%-14s %14s %14s\n", "requests", formatInt(all.TotalRequests), formatInt(realTraffic.TotalRequests))
+	fmt.Fprintf(w, "%-14s %14s %14s\n", "unique IPs", formatInt(all.UniqueIPs), formatInt(realTraffic.UniqueIPs))
+	fmt.Fprintf(w, "%-14s %14s %14s\n", "unique paths", formatInt(all.UniquePaths), formatInt(realTraffic.UniquePaths))
+	fmt.Fprintf(w, "%-14s %14s %14s\n", "5xx", formatPercent(all.ServerErrorPct), formatPercent(realTraffic.ServerErrorPct))
+	fmt.Fprintf(w, "Health checks and monitors: %s requests (%s)\n", formatInt(probes), formatPercent(probePct))
+}
 
-	// 3. Get and print the top 5 results for each category
-	const topN = 5
+// printRPS prints the average requests per second over the time span of
+// the timestamped requests, from the first to the last one.
+func (la *LogAnalyzer) printRPS() {
+	timed := 0
+	for _, n := range la.minuteCounts {
+		timed += n
+	}
+	switch {
+	case timed == 0:
+		fmt.Println("Requests per second: no timestamped requests")
+	case !la.lastTime.After(la.firstTime):
+		fmt.Printf("Requests per second: all %s timestamped requests at %s, no time span to average over\n",
+			formatInt(timed), formatTimestamp(la.firstTime))
+	default:
+		span := la.lastTime.Sub(la.firstTime)
+		fmt.Printf("Requests per second: %s on average over %s (%s to %s)\n",
+			formatFloat(float64(timed)/span.Seconds()), span, formatTimestamp(la.firstTime), formatTimestamp(la.lastTime))
+	}
+}
 
-	// Top 5 IP addresses
-	topIPs := getTopN(analyzer.ipCounts, topN)
-	printResults("Top 5 IP addresses with the most requests", topIPs)
+// summaryDoc is the document written by -summary-only in the structured
+// formats: the headline metrics, and those of the real traffic when
+// health checks or monitors are configured.
+type summaryDoc struct {
+	XMLName xml.Name `json:"-" xml:"summary"`
+	summary
+	Real *summary `json:"real,omitempty" xml:"real,omitempty"`
+}
 
-	// Top 5 most requested paths
-	topPaths := getTopN(analyzer.pathCounts, topN)
-	printResults("Top 5 most requested paths", topPaths)
+// summaryDocOf returns the summaryDoc of results.
+func summaryDocOf(results Results) summaryDoc {
+	return summaryDoc{summary: results.Summary, Real: results.RealSummary}
+}
 
-	// Top 5 response status codes
-	topStatuses := getTopN(analyzer.statusCounts, topN)
-	printResults("Top 5 response status codes", topStatuses)
+// isProbe reports whether a request is health check or monitoring
+// traffic: a request for one of healthPaths, or from one of monitorIPs.
+func (la *LogAnalyzer) isProbe(entry LogEntry) bool {
+	if la.healthPaths[stripQuery(entry.Path)] {
+		return true
+	}
+	return inPrefixes(la.monitorIPs, entry.IP)
+}
 
-	// Top 5 user agents
-	topAgents := getTopN(analyzer.agentCounts, topN)
-	printResults("Top 5 user agents", topAgents)
+// inPrefixes reports whether ip is an address within one of prefixes.
+func inPrefixes(prefixes []netip.Prefix, ip string) bool {
+	if len(prefixes) == 0 {
+		return false
+	}
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	for _, p := range prefixes {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
 
-	fmt.Println("\nAnalysis complete.")
+// ipListValues expands -ip-whitelist values: each is the name of a file
+// with one address or range per line, or a comma separated list.
+func ipListValues(values []string) ([]string, error) {
+	var ips []string
+	for _, v := range values {
+		if info, err := os.Stat(v); err == nil && info.Mode().IsRegular() {
+			lines, err := loadPatterns(v)
+			if err != nil {
+				return nil, err
+			}
+			ips = append(ips, lines...)
+			continue
+		}
+		for _, ip := range strings.Split(v, ",") {
+			if ip = strings.TrimSpace(ip); ip != "" {
+				ips = append(ips, ip)
+			}
+		}
+	}
+	return ips, nil
+}
+
+// tracksProbes reports whether health paths or monitor IPs are configured,
+// so the real traffic summary differs from the raw one.
+func (la *LogAnalyzer) tracksProbes() bool {
+	return len(la.healthPaths) > 0 || len(la.monitorIPs) > 0
+}
+
+// parsePrefixes parses IP addresses and CIDR ranges, such as "10.0.0.7" or
+// "10.0.0.0/8". A single address is a prefix of its full length.
+func parsePrefixes(values []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(values))
+	for _, v := range values {
+		if strings.Contains(v, "/") {
+			p, err := netip.ParsePrefix(v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid IP range %q: %w", v, err)
+			}
+			prefixes = append(prefixes, p.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid IP address %q: %w", v, err)
+		}
+		prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return prefixes, nil
+}
+
+// totalRequests returns the number of matched requests.
+func (la *LogAnalyzer) totalRequests() int {
+	total := 0
+	for _, count := range la.statusCounts {
+		total += count
+	}
+	return total
+}
+
+// serverErrorPercent returns the percentage of matched requests that got a
+// 5xx response, or 0 when nothing matched.
+func (la *LogAnalyzer) serverErrorPercent() float64 {
+	return serverErrorShare(la.statusCounts)
+}
+
+// serverErrorShare returns the percentage of the requests in per status
+// code counts that got a 5xx response, or 0 when there are none.
+func serverErrorShare(statusCounts map[string]int) float64 {
+	total, errors := 0, 0
+	for code, count := range statusCounts {
+		total += count
+		if strings.HasPrefix(code, "5") {
+			errors += count
+		}
+	}
+	if total == 0 {
+		return 0
+	}
+	return float64(errors) * 100 / float64(total)
+}
+
+// analyze processes the log content line by line. Reports wait for the
+// whole batch of lines to be counted.
+func (la *LogAnalyzer) analyze(logContent string) {
+	lines := strings.Split(logContent, "\n")
+	fmt.Fprintf(statusOut, "Processing %s log lines...\n", formatInt(len(lines)))
+	la.analyzeLines(lines)
+}
+
+// cleanLine prepares a raw log line for parsing. Trailing whitespace, such
+// as the "\r" of CRLF line endings, would end up in the last field of a
+// custom regex, and make blank lines look like unparsed ones; with -syslog
+// the syslog header is removed too.
+func (la *LogAnalyzer) cleanLine(line string) string {
+	line = strings.TrimRight(line, " \t\r")
+	if la.syslog {
+		line = stripSyslog(line)
+	}
+	return line
+}
+
+// analyzeLines is analyze without the progress message.
+func (la *LogAnalyzer) analyzeLines(lines []string) {
+	for i, line := range lines {
+		lines[i] = la.cleanLine(line)
+	}
+	var lineNumbers []int
+	if la.joinContinuations {
+		lines, lineNumbers = joinContinuations(lines)
+	}
+	la.mu.Lock()
+	defer la.mu.Unlock()
+
+	explainedMatch := false
+	for i, line := range lines {
+		lineNo := i + 1
+		if lineNumbers != nil {
+			lineNo = lineNumbers[i]
+		}
+		if la.firstLine > 1 {
+			lineNo += la.firstLine - 1
+		}
+		if la.stop.Load() {
+			la.partial = true
+			break
+		}
+		if line == "" || la.directive(line) {
+			continue
+		}
+		la.lines++
+
+		entry, format, ok := la.parseLine(line)
+		if ok {
+			la.matched++
+			entry.Method = strings.ToUpper(entry.Method)
+		}
+		if ok && la.anonymizeIPs {
+			entry.IP = anonymizeIP(entry.IP)
+		}
+		if ok && la.foldPathCase {
+			entry.Path = strings.ToLower(entry.Path)
+		}
+		rawPath := entry.Path
+		if ok && la.cleanPaths {
+			entry.Path = cleanPath(entry.Path)
+		}
+		if ok && la.trimTrailingSlash {
+			entry.Path = trimTrailingSlash(entry.Path)
+		}
+		if ok && la.foldAgentCase {
+			entry.UserAgent = strings.ToLower(entry.UserAgent)
+		}
+		rawStatus := entry.StatusCode
+		if ok && la.normalizeStatus {
+			entry.StatusCode = statusFamily(entry.StatusCode)
+		}
+		if la.explainOut != nil {
+			// Dump the first explainLines lines, and the first matching
+			// line as a sample if none of those matched.
+			if la.explainLines == 0 || i < la.explainLines || (ok && !explainedMatch) {
+				explainLine(la.explainOut, lineNo, line, entry, format, ok)
+			}
+			explainedMatch = explainedMatch || ok
+		}
+		if !ok {
+			if m, found := parseMalformed(line); found {
+				if la.anonymizeIPs {
+					m.ip = anonymizeIP(m.ip)
+				}
+				if !inPrefixes(la.securityWhitelist, m.ip) {
+					la.countMalformed(m)
+				}
+			} else {
+				la.recordSkip(lineNo, line)
+			}
+		}
+		if ok && la.vhostFilter != "" && entryHost(entry) != la.vhostFilter {
+			continue
+		}
+		if ok && la.excludePaths[stripQuery(entry.Path)] {
+			continue
+		}
+		if ok && !la.keepsStatus(rawStatus) {
+			la.statusFiltered++
+			continue
+		}
+		if ok {
+			la.formatCounts[format]++
+			if isTraversal(rawPath) && !inPrefixes(la.securityWhitelist, entry.IP) {
+				incrementNested(la.traversalHits, rawPath, entry.IP)
+			}
+			if isAuthFailure(rawStatus) && !inPrefixes(la.securityWhitelist, entry.IP) {
+				incrementNested(la.authFailures, entry.IP, rawStatus)
+			}
+			if la.entryOut != nil && la.entryErr == nil {
+				if la.entryLines {
+					la.entryErr = la.entryOut.Encode(numberedEntry{Source: la.source, Line: lineNo, LogEntry: entry})
+				} else {
+					la.entryErr = la.entryOut.Encode(entry)
+				}
+			}
+
+			la.count(entry)
+		}
+	}
+	la.syncTopTrackers()
+}
+
+// numberedEntry is an entry as -emit-entries writes it with
+// -emit-line-numbers: the entry's fields, after the source it was read
+// from, as in the -verbose skipped lines, and its line number there.
+type numberedEntry struct {
+	Source string `json:"source"`
+	Line   int    `json:"line"`
+	LogEntry
+}
+
+// statusRanges is a set of status codes, as inclusive ranges.
+type statusRanges [][2]int
+
+// parseStatusRanges parses a comma separated list of status codes, ranges
+// and classes, such as "200,301-308,5xx".
+func parseStatusRanges(s string) (statusRanges, error) {
+	var ranges statusRanges
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		lo, hi, isRange := strings.Cut(part, "-")
+		if class, ok := strings.CutSuffix(strings.ToLower(part), "xx"); ok && len(class) == 1 && isDigit(class[0]) {
+			d := int(class[0] - '0')
+			ranges = append(ranges, [2]int{d * 100, d*100 + 99})
+			continue
+		}
+		if !isRange {
+			hi = lo
+		}
+		from, err1 := strconv.Atoi(lo)
+		to, err2 := strconv.Atoi(hi)
+		if err1 != nil || err2 != nil || from > to {
+			return nil, fmt.Errorf("invalid status code or range %q (want e.g. 404, 500-599 or 5xx)", part)
+		}
+		ranges = append(ranges, [2]int{from, to})
+	}
+	return ranges, nil
+}
+
+// contains reports whether a status code is in one of the ranges.
+func (r statusRanges) contains(code string) bool {
+	n, err := strconv.Atoi(code)
+	if err != nil {
+		return false
+	}
+	for _, rng := range r {
+		if n >= rng[0] && n <= rng[1] {
+			return true
+		}
+	}
+	return false
+}
+
+// keepsStatus reports whether a request with this status code passes
+// includeStatus, when set, then excludeStatus and statusRegex.
+func (la *LogAnalyzer) keepsStatus(code string) bool {
+	if la.includeStatus != nil && !la.includeStatus.contains(code) {
+		return false
+	}
+	if la.statusRegex != nil && !la.statusRegex.MatchString(code) {
+		return false
+	}
+	return !la.excludeStatus.contains(code)
+}
+
+// syslogPrefix matches the header that syslog puts before each message,
+// for -syslog. The first form is RFC 3164, "<190>Oct 10 13:55:36 host
+// nginx[123]: ", also without the priority or with an ISO 8601 time as
+// rsyslog writes to files; the second is RFC 5424, "<190>1
+// 2023-10-10T13:55:36Z host nginx 123 - - ", with its structured data.
+var syslogPrefix = regexp.MustCompile(`^(?:(?:<\d{1,3}>)?(?:[A-Z][a-z]{2} [ \d]\d \d\d:\d\d:\d\d|\d{4}-\d\d-\d\dT\S+) \S+ [^\s:\[]+(?:\[\d+\])?: ?` +
+	`|<\d{1,3}>\d{1,2} \S+ \S+ \S+ \S+ \S+ (?:-|(?:\[(?:[^\]\\]|\\.)*\])+) ?)`)
+
+// stripSyslog returns line without its syslog header, or unchanged if it
+// has none.
+func stripSyslog(line string) string {
+	if loc := syslogPrefix.FindStringIndex(line); loc != nil {
+		return line[loc[1]:]
+	}
+	return line
+}
+
+// joinContinuations appends every line that does not look like the start
+// of an entry (see isEntryStart) to the entry before it, separated by a
+// space, and returns the joined entries with the line number each starts
+// at. Blank lines are kept, to be skipped as usual.
+func joinContinuations(lines []string) ([]string, []int) {
+	joined := make([]string, 0, len(lines))
+	numbers := make([]int, 0, len(lines))
+	for i, line := range lines {
+		if len(joined) > 0 && line != "" && !isEntryStart(line) {
+			joined[len(joined)-1] += " " + strings.TrimSpace(line)
+			continue
+		}
+		joined = append(joined, line)
+		numbers = append(numbers, i+1)
+	}
+	return joined, numbers
+}
+
+// isEntryStart reports whether a line looks like the first line of a log
+// entry: its first field is an IP address, or its second is (for logs that
+// start with the virtual host), it starts with a "[" timestamp or an ISO
+// 8601 date such as 2024-10-04, or it is a "#" directive. Anything else, such as an indented
+// stack frame or "Caused by: ...", continues the entry before it.
+func isEntryStart(line string) bool {
+	if strings.HasPrefix(line, "[") || strings.HasPrefix(line, "#") || isISODate(line) {
+		return true
+	}
+	first, rest, _ := strings.Cut(line, " ")
+	if _, err := netip.ParseAddr(first); err == nil {
+		return true
+	}
+	second, _, _ := strings.Cut(rest, " ")
+	_, err := netip.ParseAddr(second)
+	return err == nil
+}
+
+// isISODate reports whether s starts with a YYYY-MM-DD date.
+func isISODate(s string) bool {
+	if len(s) < 10 || s[4] != '-' || s[7] != '-' {
+		return false
+	}
+	for _, i := range []int{0, 1, 2, 3, 5, 6, 8, 9} {
+		if !isDigit(s[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// malformedRegex is the looser parse of lines whose CLF request line is
+// not a known method and path, such as the raw bytes sent by port scanners.
+var malformedRegex = regexp.MustCompile(`^(\S+) \S+ \S+ \[[^\]]*\] "((?:[^"\\]|\\.)*)" (\d{3}) `)
+
+// malformedRequest is what parseMalformed extracts from a line.
+type malformedRequest struct {
+	ip, request, status string
+}
+
+// malformedReason says what is wrong with a request line that the formats
+// rejected, looking at its raw method token and path.
+func malformedReason(request string) string {
+	fields := strings.Fields(request)
+	if len(fields) == 0 {
+		return "empty request line"
+	}
+	method := fields[0]
+	for i := 0; i < len(method); i++ {
+		if method[i] < 'A' || method[i] > 'Z' {
+			return "invalid method"
+		}
+	}
+	if !slices.Contains(requestMethods, method) {
+		return "unknown method " + method
+	}
+	if len(fields) < 2 {
+		return "missing path"
+	}
+	if path := fields[1]; !strings.HasPrefix(path, "/") && path != "*" && !strings.Contains(path, "://") {
+		return "malformed path"
+	}
+	return "other"
+}
+
+// parseMalformed matches a line that the formats rejected against
+// malformedRegex.
+func parseMalformed(line string) (malformedRequest, bool) {
+	m := malformedRegex.FindStringSubmatch(line)
+	if m == nil {
+		return malformedRequest{}, false
+	}
+	return malformedRequest{ip: m[1], request: m[2], status: m[3]}, true
+}
+
+// countMalformed counts a malformed request by client IP, request line and
+// status code.
+func (la *LogAnalyzer) countMalformed(m malformedRequest) {
+	la.malformed++
+	la.malformedIPs[la.boundedKey(la.malformedIPs, "malformed IPs", m.ip)]++
+	la.malformedReasons[malformedReason(m.request)]++
+	request := m.request
+	if request == "" {
+		request = noneKey
+	}
+	if _, ok := la.malformedLines[request]; !ok && la.maxCardinality > 0 && len(la.malformedLines) >= la.maxCardinality {
+		la.overflowed["malformed request lines"] = true
+		request = overflowKey
+	}
+	incrementNested(la.malformedLines, request, m.ip)
+	la.malformedStatus[m.status]++
+}
+
+// printMalformed prints the number of malformed requests by reason, with
+// their top client IPs, request lines (by client IP) and status codes.
+func (la *LogAnalyzer) printMalformed(n int) {
+	fmt.Printf("\nMalformed requests (no valid method and path): %s\n", formatInt(la.malformed))
+	if la.malformed == 0 {
+		return
+	}
+	top := topLabel(n)
+	printResults("Malformed requests by reason", getTopN(la.malformedReasons, 0))
+	printResults(top+" IP addresses sending malformed requests", getTopN(la.malformedIPs, n))
+	printBreakdown(top+" malformed request lines (by client IP)", la.malformedLines, n, n, "requests")
+	printStatusResults("Malformed request status codes", getTopN(la.malformedStatus, 0))
+}
+
+// skippedLine is a line that matched none of the formats.
+type skippedLine struct {
+	source string
+	number int
+	text   string
+}
+
+// maxSkipText caps the length of the skipped line samples kept.
+const maxSkipText = 200
+
+// recordSkip counts an unparsed line, keeping its position and content if
+// fewer than maxSkipSamples lines have been kept so far. With anonymizeIPs
+// the addresses in the kept content are masked too.
+func (la *LogAnalyzer) recordSkip(number int, line string) {
+	la.skipped++
+	if len(la.skipSamples) < la.maxSkipSamples {
+		if la.anonymizeIPs {
+			line = anonymizeText(line)
+		}
+		la.skipSamples = append(la.skipSamples, skippedLine{source: la.source, number: number, text: truncateLabel(line, maxSkipText)})
+	}
+}
+
+// printSkipped writes the number of unparsed lines and the kept samples.
+func (la *LogAnalyzer) printSkipped(w io.Writer) {
+	if la.skipped == 0 {
+		fmt.Fprintln(w, "Every non-empty line was parsed.")
+		return
+	}
+	fmt.Fprintf(w, "Skipped %s lines that matched no log format", formatInt(la.skipped))
+	if len(la.skipSamples) == 0 {
+		fmt.Fprintln(w, ".")
+		return
+	}
+	fmt.Fprintf(w, ", the first %s:\n", formatInt(len(la.skipSamples)))
+	for _, s := range la.skipSamples {
+		fmt.Fprintf(w, "  %s line %s: %q\n", s.source, formatInt(s.number), s.text)
+	}
+}
+
+// noneKey counts the requests whose user agent, referrer or response
+// size is the "-" placeholder, unless dropEmpty is set.
+const noneKey = "(none)"
+
+// placeholder maps the "-" that logs write for a missing field to noneKey,
+// or to "" (not counted) when dropEmpty is set. Other values are returned
+// unchanged.
+func (la *LogAnalyzer) placeholder(field string) string {
+	if field != "-" {
+		return field
+	}
+	if la.dropEmpty {
+		return ""
+	}
+	return noneKey
+}
+
+// missing maps a field that was not logged at all to noneKey, or to ""
+// (not counted) when dropEmpty is set.
+func (la *LogAnalyzer) missing(field string) string {
+	if field == "" && !la.dropEmpty {
+		return noneKey
+	}
+	return field
+}
+
+// overflowKey collects the counts of new values once a count map has
+// reached maxCardinality keys.
+const overflowKey = "(overflow)"
+
+// boundedKey returns key, or overflowKey if key is new and counts already
+// holds maxCardinality keys. name identifies the map in the overflow
+// warning.
+func (la *LogAnalyzer) boundedKey(counts map[string]int, name, key string) string {
+	if la.maxCardinality <= 0 || len(counts) < la.maxCardinality {
+		return key
+	}
+	if _, ok := counts[key]; ok {
+		return key
+	}
+	la.overflowed[name] = true
+	return overflowKey
+}
+
+// count adds a parsed entry to every count map.
+func (la *LogAnalyzer) count(entry LogEntry) {
+	// Sensitive path probes are checked against the raw path, since they
+	// are rare by nature and must not be lost to overflow.
+	if la.isSensitivePath(entry.Path) && !inPrefixes(la.securityWhitelist, entry.IP) {
+		incrementNested(la.sensitiveHits, entry.Path, entry.IP)
+	}
+	probe := la.isProbe(entry)
+
+	entry.IP = la.boundedKey(la.ipCounts, "ips", entry.IP)
+	entry.Path = la.boundedKey(la.pathCounts, "paths", entry.Path)
+	entry.StatusCode = la.boundedKey(la.statusCounts, "status", entry.StatusCode)
+	la.add(la.ipCounts, la.ipTop, entry.IP)
+	la.add(la.pathCounts, la.pathTop, entry.Path)
+	la.statusCounts[entry.StatusCode]++
+	if la.trackIPPaths {
+		addDistinct(la.ipPaths, entry.IP, entry.Path, maxPathsPerIP)
+	}
+	if !probe {
+		la.realIPs[entry.IP]++
+		la.realPaths[entry.Path]++
+		la.realStatus[entry.StatusCode]++
+	}
+	entry.UserAgent = la.placeholder(entry.UserAgent)
+	if entry.UserAgent != "" && la.trackIPAgents {
+		addDistinct(la.ipAgents, entry.IP, entry.UserAgent, maxAgentsPerIP)
+	}
+	if entry.UserAgent != "" {
+		if la.dedupeAgents {
+			entry.UserAgent = stripAgentVersions(entry.UserAgent)
+		}
+		entry.UserAgent = la.boundedKey(la.agentCounts, "agents", entry.UserAgent)
+		la.add(la.agentCounts, la.agentTop, entry.UserAgent)
+	}
+	if entry.Bytes >= 0 {
+		la.sizeBucketCounts[sizeBucket(entry.Bytes)]++
+		la.bytesPerStatus[entry.StatusCode] += entry.Bytes
+		la.ipBytes[entry.IP] += entry.Bytes
+		la.pathBytes[entry.Path] += entry.Bytes
+		if entry.UserAgent != "" {
+			la.agentBytes[entry.UserAgent] += entry.Bytes
+		}
+	} else if !la.dropEmpty {
+		la.sizeBucketCounts[noneKey]++
+	}
+	if protocol := la.missing(entry.Protocol); protocol != "" {
+		la.protocolCounts[la.boundedKey(la.protocolCounts, "protocols", protocol)]++
+	}
+	if method := la.missing(entry.Method); method != "" {
+		la.methodCounts[method]++
+		incrementNested(la.methodClassCounts, method, statusClass(entry.StatusCode))
+	}
+	key := fingerprint(entry)
+	la.fingerprintCounts[la.boundedKey(la.fingerprintCounts, "fingerprints", key)]++
+	if entry.Referer == "-" {
+		la.directPaths[entry.Path]++
+	}
+	if referer := la.placeholder(entry.Referer); referer != "" {
+		la.refererCounts[la.boundedKey(la.refererCounts, "referers", referer)]++
+	}
+	if entry.User != "" && entry.User != "-" {
+		la.userCounts[la.boundedKey(la.userCounts, "users", entry.User)]++
+	}
+	if host := entryHost(entry); host != "" {
+		la.hostCounts[la.boundedKey(la.hostCounts, "hosts", host)]++
+	}
+	incrementNested(la.statusPathCounts, entry.StatusCode, entry.Path)
+	if la.trackLatency && entry.Duration >= 0 {
+		la.pathDurations[entry.Path] = append(la.pathDurations[entry.Path], entry.Duration)
+	}
+	if !entry.Timestamp.IsZero() {
+		la.recordTime(entry)
+	}
+	if isErrorStatus(entry.StatusCode) {
+		incrementNested(la.errorPathStatus, entry.Path, entry.StatusCode)
+	}
+}
+
+// Merge adds the counts of other, typically an analyzer of another shard
+// of the same logs, into la. Both should have been configured alike, in
+// particular with the same bucket size; maxCardinality is not enforced
+// on the merged keys. other must not be la.
+func (la *LogAnalyzer) Merge(other *LogAnalyzer) {
+	la.mu.Lock()
+	defer la.mu.Unlock()
+	other.mu.RLock()
+	defer other.mu.RUnlock()
+	for _, t := range []struct {
+		dst  *topTracker
+		src  map[string]int
+		into map[string]int
+	}{
+		{la.ipTop, other.ipCounts, la.ipCounts},
+		{la.pathTop, other.pathCounts, la.pathCounts},
+		{la.agentTop, other.agentCounts, la.agentCounts},
+	} {
+		if t.dst == nil {
+			mergeCounts(t.into, t.src)
+			continue
+		}
+		for key, n := range t.src {
+			t.dst.add(key, n)
+		}
+	}
+	la.syncTopTrackers()
+	for _, m := range []struct{ dst, src map[string]int }{
+		{la.statusCounts, other.statusCounts},
+		{la.sizeBucketCounts, other.sizeBucketCounts},
+		{la.hostCounts, other.hostCounts},
+		{la.refererCounts, other.refererCounts},
+		{la.directPaths, other.directPaths},
+		{la.userCounts, other.userCounts},
+		{la.protocolCounts, other.protocolCounts},
+		{la.methodCounts, other.methodCounts},
+		{la.fingerprintCounts, other.fingerprintCounts},
+		{la.malformedIPs, other.malformedIPs},
+		{la.malformedReasons, other.malformedReasons},
+		{la.malformedStatus, other.malformedStatus},
+		{la.formatCounts, other.formatCounts},
+		{la.realIPs, other.realIPs},
+		{la.realPaths, other.realPaths},
+		{la.realStatus, other.realStatus},
+	} {
+		mergeCounts(m.dst, m.src)
+	}
+	mergeCounts(la.agentBytes, other.agentBytes)
+	mergeCounts(la.ipBytes, other.ipBytes)
+	mergeCounts(la.pathBytes, other.pathBytes)
+	mergeCounts(la.bytesPerStatus, other.bytesPerStatus)
+	mergeCounts(la.bytesBuckets, other.bytesBuckets)
+	mergeCounts(la.requestBuckets, other.requestBuckets)
+	mergeCounts(la.minuteCounts, other.minuteCounts)
+	mergeNested(la.errorPathStatus, other.errorPathStatus)
+	mergeNested(la.statusPathCounts, other.statusPathCounts)
+	mergeNested(la.sensitiveHits, other.sensitiveHits)
+	mergeNested(la.traversalHits, other.traversalHits)
+	mergeNested(la.authFailures, other.authFailures)
+	mergeNested(la.methodClassCounts, other.methodClassCounts)
+	mergeNested(la.malformedLines, other.malformedLines)
+	mergeNested(la.ipBuckets, other.ipBuckets)
+	for ip, s := range other.ipSeen {
+		seen, ok := la.ipSeen[ip]
+		if !ok || s[0].Before(seen[0]) {
+			seen[0] = s[0]
+		}
+		if s[1].After(seen[1]) {
+			seen[1] = s[1]
+		}
+		la.ipSeen[ip] = seen
+	}
+	for hour, counts := range other.hourClassCounts {
+		if counts == nil {
+			continue
+		}
+		if la.hourClassCounts[hour] == nil {
+			la.hourClassCounts[hour] = make(map[string]int)
+		}
+		mergeCounts(la.hourClassCounts[hour], counts)
+	}
+	for ip, paths := range other.ipPaths {
+		for path := range paths {
+			addDistinct(la.ipPaths, ip, path, maxPathsPerIP)
+		}
+	}
+	for ip, agents := range other.ipAgents {
+		for agent := range agents {
+			addDistinct(la.ipAgents, ip, agent, maxAgentsPerIP)
+		}
+	}
+	for path, durations := range other.pathDurations {
+		la.pathDurations[path] = append(la.pathDurations[path], durations...)
+	}
+	for path, times := range other.pathTimes {
+		la.pathTimes[path] = append(la.pathTimes[path], times...)
+	}
+	for name := range other.overflowed {
+		la.overflowed[name] = true
+	}
+
+	la.lines += other.lines
+	la.matched += other.matched
+	la.statusFiltered += other.statusFiltered
+	la.malformed += other.malformed
+	la.skipped += other.skipped
+	for _, s := range other.skipSamples {
+		if len(la.skipSamples) >= la.maxSkipSamples {
+			break
+		}
+		la.skipSamples = append(la.skipSamples, s)
+	}
+	if !other.firstTime.IsZero() && (la.firstTime.IsZero() || other.firstTime.Before(la.firstTime)) {
+		la.firstTime = other.firstTime
+	}
+	if other.lastTime.After(la.lastTime) {
+		la.lastTime = other.lastTime
+	}
+	la.partial = la.partial || other.partial
+	la.sources = append(la.sources, other.sources...)
+}
+
+// mergeCounts adds the counts of src into dst.
+func mergeCounts[K comparable, V int | int64](dst, src map[K]V) {
+	for k, v := range src {
+		dst[k] += v
+	}
+}
+
+// mergeNested adds the nested counts of src into dst.
+func mergeNested[K1, K2 comparable](dst, src map[K1]map[K2]int) {
+	for k, inner := range src {
+		if dst[k] == nil {
+			dst[k] = make(map[K2]int, len(inner))
+		}
+		mergeCounts(dst[k], inner)
+	}
+}
+
+// maxPathsPerIP caps the distinct paths kept per IP for -unique-paths-per-ip,
+// bounding its memory use on crawls of huge sites. maxAgentsPerIP does the
+// same for -agents-per-ip.
+const (
+	maxPathsPerIP  = 10000
+	maxAgentsPerIP = 1000
+)
+
+// addDistinct adds value to the set of key in sets, unless that set
+// already holds limit values.
+func addDistinct(sets map[string]map[string]struct{}, key, value string, limit int) {
+	set := sets[key]
+	if set == nil {
+		set = make(map[string]struct{})
+		sets[key] = set
+	}
+	if len(set) < limit {
+		set[value] = struct{}{}
+	}
+}
+
+// printAgentsPerIP prints the n IPs that sent the most distinct user
+// agents, with their total requests, flagging those with more than
+// maxAgents of them (0 to disable), as bots rotating their agent do. The
+// securityWhitelist IPs are left out.
+func (la *LogAnalyzer) printAgentsPerIP(n, maxAgents int) {
+	distinct := make(map[string]int, len(la.ipAgents))
+	for ip, agents := range la.ipAgents {
+		if !inPrefixes(la.securityWhitelist, ip) {
+			distinct[ip] = len(agents)
+		}
+	}
+	fmt.Printf("\n%s IP addresses by distinct user agents:\n", topLabel(n))
+	for _, item := range getTopN(distinct, n) {
+		count := formatInt(item.Count)
+		if item.Count >= maxAgentsPerIP {
+			count += "+"
+		}
+		value := colorize(item.Value, ansiBold)
+		detail := colorize(fmt.Sprintf("%s distinct agents, %s", count, requestsLabel(la.ipCounts, item.Value)), ansiDim)
+		if maxAgents > 0 && item.Count > maxAgents {
+			detail += " " + colorize("(rotating agents)", ansiRed)
+		}
+		fmt.Printf("%s - %s\n", value, detail)
+	}
+}
+
+// fingerprint identifies the exact request pattern of an entry, its
+// method, path and status code, e.g. "GET /wp-login.php 404", so repeats
+// of the same exploit attempt count together. The method is left out when
+// the log has none.
+func fingerprint(entry LogEntry) string {
+	if entry.Method == "" {
+		return entry.Path + " " + entry.StatusCode
+	}
+	return entry.Method + " " + entry.Path + " " + entry.StatusCode
+}
+
+// requestsLabel renders the requests of key in counts, e.g. "12
+// requests", or "requests not tracked" when -approx-top dropped key from
+// counts for being too rare.
+func requestsLabel(counts map[string]int, key string) string {
+	requests, ok := counts[key]
+	if !ok {
+		return "requests not tracked"
+	}
+	return formatInt(requests) + " requests"
+}
+
+// isAuthFailure reports whether a status code refuses a client for its
+// credentials: 401 Unauthorized or 403 Forbidden.
+func isAuthFailure(code string) bool {
+	return code == "401" || code == "403"
+}
+
+// printAuthFailures prints the n IPs with at least minFailures 401 and 403
+// responses, as from credential stuffing or probing of protected pages,
+// with their split by code and total requests.
+func (la *LogAnalyzer) printAuthFailures(n, minFailures int) {
+	failures := make(map[string]int)
+	for ip, codes := range la.authFailures {
+		total := codes["401"] + codes["403"]
+		if total >= minFailures {
+			failures[ip] = total
+		}
+	}
+	fmt.Printf("\n%s IP addresses by auth failures (at least %s 401/403 responses):\n", topLabel(n), formatInt(minFailures))
+	if len(failures) == 0 {
+		fmt.Println("(none found)")
+		return
+	}
+	for _, item := range getTopN(failures, n) {
+		codes := la.authFailures[item.Value]
+		value := colorize(item.Value, ansiBold)
+		detail := colorize(fmt.Sprintf("%s failures (401: %s, 403: %s), %s",
+			formatInt(item.Count), formatInt(codes["401"]), formatInt(codes["403"]), requestsLabel(la.ipCounts, item.Value)), ansiDim)
+		fmt.Printf("%s - %s\n", value, detail)
+	}
+}
+
+// isScanner reports whether an IP that requested distinct paths out of
+// requests looks like a scanner: at least minPaths distinct paths, most
+// of them requested only once, as when probing for files rather than
+// browsing or polling a few pages.
+func isScanner(distinct, requests, minPaths int) bool {
+	return minPaths > 0 && distinct >= minPaths && distinct*2 >= requests
+}
+
+// printUniquePathsPerIP prints the n IPs that requested the most distinct
+// paths, with their total requests, flagging those isScanner matches with
+// minPaths. The securityWhitelist IPs are left out.
+func (la *LogAnalyzer) printUniquePathsPerIP(n, minPaths int) {
+	distinct := make(map[string]int, len(la.ipPaths))
+	for ip, paths := range la.ipPaths {
+		if !inPrefixes(la.securityWhitelist, ip) {
+			distinct[ip] = len(paths)
+		}
+	}
+	fmt.Printf("\n%s IP addresses by distinct paths requested:\n", topLabel(n))
+	for _, item := range getTopN(distinct, n) {
+		count := formatInt(item.Count)
+		if item.Count >= maxPathsPerIP {
+			count += "+"
+		}
+		value := colorize(item.Value, ansiBold)
+		requests, tracked := la.ipCounts[item.Value]
+		detail := colorize(fmt.Sprintf("%s distinct paths, %s", count, requestsLabel(la.ipCounts, item.Value)), ansiDim)
+		if tracked && isScanner(item.Count, requests, minPaths) {
+			detail += " " + colorize("(possible scanner)", ansiRed)
+		}
+		fmt.Printf("%s - %s\n", value, detail)
+	}
+}
+
+// add counts key in top when it is set, or else in counts.
+func (la *LogAnalyzer) add(counts map[string]int, top *topTracker, key string) {
+	if top != nil {
+		top.add(key, 1)
+		return
+	}
+	counts[key]++
+}
+
+// useTopTrackers makes the ip, path and agent counts approximate, each
+// keeping only the capacity most frequent keys (see topTracker).
+func (la *LogAnalyzer) useTopTrackers(capacity int) {
+	la.ipTop = newTopTracker(capacity)
+	la.pathTop = newTopTracker(capacity)
+	la.agentTop = newTopTracker(capacity)
+}
+
+// syncTopTrackers replaces the ip, path and agent count maps with the
+// current counts of their trackers, if any.
+func (la *LogAnalyzer) syncTopTrackers() {
+	for _, t := range []struct {
+		counts *map[string]int
+		top    *topTracker
+	}{
+		{&la.ipCounts, la.ipTop},
+		{&la.pathCounts, la.pathTop},
+		{&la.agentCounts, la.agentTop},
+	} {
+		if t.top != nil {
+			*t.counts = t.top.counts()
+		}
+	}
+}
+
+// warnOverflow prints a warning for every count map that hit
+// maxCardinality.
+func (la *LogAnalyzer) warnOverflow() {
+	for _, c := range []string{"ips", "paths", "status", "agents", "hosts", "referers", "protocols", "fingerprints", "malformed IPs", "malformed request lines"} {
+		if la.overflowed[c] {
+			fmt.Fprintf(statusOut, "Warning: reached %s distinct %s (-max-cardinality), further new values are counted as %s\n",
+				formatInt(la.maxCardinality), c, overflowKey)
+		}
+	}
+}
+
+// warnMixedFormats prints a warning when lines of more than one format
+// have been analyzed.
+func (la *LogAnalyzer) warnMixedFormats() {
+	if len(la.formatCounts) > 1 {
+		var parts []string
+		for _, item := range getTopN(la.formatCounts, len(la.formatCounts)) {
+			parts = append(parts, fmt.Sprintf("%s=%s", item.Value, formatInt(item.Count)))
+		}
+		fmt.Fprintf(statusOut, "Warning: log appears to mix formats (%s)\n", strings.Join(parts, ", "))
+	}
+}
+
+// foldedFields lists the fields that are lowercased before counting.
+func (la *LogAnalyzer) foldedFields() []string {
+	var fields []string
+	if la.foldPathCase {
+		fields = append(fields, "paths")
+	}
+	if la.foldAgentCase {
+		fields = append(fields, "user agents")
+	}
+	return fields
+}
+
+// anonymizeIP masks the host part of an address: the last octet of an IPv4
+// address (a /24) or the last 80 bits of an IPv6 address (a /48). Values
+// that are not IP addresses are returned unchanged.
+func anonymizeIP(ip string) string {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return ip
+	}
+	if v4 := parsed.To4(); v4 != nil {
+		return v4.Mask(net.CIDRMask(24, 32)).String()
+	}
+	return parsed.Mask(net.CIDRMask(48, 128)).String()
+}
+
+// ipLike matches the substrings of a line that may be IPv4 or IPv6
+// addresses; anonymizeIP leaves the ones that do not parse unchanged.
+var ipLike = regexp.MustCompile(`[0-9A-Fa-f]*:[0-9A-Fa-f:.]*[0-9A-Fa-f]|\d{1,3}(?:\.\d{1,3}){3}`)
+
+// anonymizeText masks every IP address found in free text, such as an
+// unparsed line, with anonymizeIP.
+func anonymizeText(s string) string {
+	return ipLike.ReplaceAllStringFunc(s, anonymizeIP)
+}
+
+// recordTime updates the time range and time-bucketed counts for an
+// entry with a valid timestamp.
+func (la *LogAnalyzer) recordTime(entry LogEntry) {
+	if la.firstTime.IsZero() || entry.Timestamp.Before(la.firstTime) {
+		la.firstTime = entry.Timestamp
+	}
+	if entry.Timestamp.After(la.lastTime) {
+		la.lastTime = entry.Timestamp
+	}
+
+	la.requestBuckets[la.bucketOf(entry.Timestamp)]++
+	la.minuteCounts[entry.Timestamp.Unix()/60]++
+	if entry.Bytes >= 0 {
+		la.bytesBuckets[la.bucketOf(entry.Timestamp)] += entry.Bytes
+	}
+
+	hour := entry.Timestamp.Hour()
+	if la.hourClassCounts[hour] == nil {
+		la.hourClassCounts[hour] = make(map[string]int)
+	}
+	la.hourClassCounts[hour][statusClass(entry.StatusCode)]++
+
+	if la.trackIPTimeline {
+		buckets := la.ipBuckets[entry.IP]
+		if buckets == nil {
+			buckets = make(map[int64]int)
+			la.ipBuckets[entry.IP] = buckets
+		}
+		buckets[la.bucketOf(entry.Timestamp)]++
+	}
+
+	if la.trackIPSeen {
+		seen, ok := la.ipSeen[entry.IP]
+		if !ok || entry.Timestamp.Before(seen[0]) {
+			seen[0] = entry.Timestamp
+		}
+		if entry.Timestamp.After(seen[1]) {
+			seen[1] = entry.Timestamp
+		}
+		la.ipSeen[entry.IP] = seen
+	}
+
+	if la.trackPathTimes {
+		la.pathTimes[entry.Path] = append(la.pathTimes[entry.Path], entry.Timestamp.UnixNano())
+	}
+}
+
+// bucketOf returns the index of the time bucket containing t, counted in
+// bucketSize steps from the Unix epoch.
+func (la *LogAnalyzer) bucketOf(t time.Time) int64 {
+	return floorDiv(t.UnixNano(), int64(la.bucketSize))
+}
+
+// floorDiv returns a/b rounded down, so that times before the epoch fall
+// in the bucket before it rather than in bucket 0.
+func floorDiv(a, b int64) int64 {
+	q := a / b
+	if a%b != 0 && (a < 0) != (b < 0) {
+		q--
+	}
+	return q
+}
+
+// maxSeriesPoints caps the length of the time series the time reports
+// lay out. When the range from firstTime to lastTime has more buckets,
+// each point covers several of them (see seriesLayout).
+const maxSeriesPoints = 1000
+
+// seriesLayout returns the first bucket of the time series from firstTime
+// to lastTime, the number of buckets each point covers and the number of
+// points.
+func (la *LogAnalyzer) seriesLayout() (first, step int64, points int) {
+	first, last := la.bucketOf(la.firstTime), la.bucketOf(la.lastTime)
+	step = (last-first)/maxSeriesPoints + 1
+	first = floorDiv(first, step) * step
+	return first, step, int((last-first)/step + 1)
+}
+
+// seriesStep returns the time each point of a series covers: bucketSize,
+// or a multiple of it for long time ranges.
+func (la *LogAnalyzer) seriesStep() time.Duration {
+	_, step, _ := la.seriesLayout()
+	return la.bucketSize * time.Duration(step)
+}
+
+// seriesStart returns the start time of the first point of a series.
+func (la *LogAnalyzer) seriesStart() time.Time {
+	first, _, _ := la.seriesLayout()
+	return time.Unix(0, first*int64(la.bucketSize)).In(la.firstTime.Location())
+}
+
+// bucketSeries lays out bucketed values as a dense slice following
+// seriesLayout, covering the range from firstTime to lastTime, so that
+// series of different keys line up.
+func bucketSeries[V int | int64](la *LogAnalyzer, buckets map[int64]V) []V {
+	if la.firstTime.IsZero() {
+		return nil
+	}
+	first, step, points := la.seriesLayout()
+	series := make([]V, points)
+	for b, v := range buckets {
+		series[(b-first)/step] += v
+	}
+	return series
+}
+
+// histogramWidth is the length of the longest bar in a time histogram.
+const histogramWidth = 40
+
+// printTimeHistogram prints one bar per time bucket, the first one
+// starting at start, scaled to the largest value. label renders each value.
+func printTimeHistogram(title string, series []int64, start time.Time, bucketSize time.Duration, label func(int64) string) {
+	fmt.Printf("\n%s:\n", title)
+	peak := int64(0)
+	for _, v := range series {
+		peak = max(peak, v)
+	}
+	t := start
+	for _, v := range series {
+		width := 0
+		if peak > 0 {
+			width = int(v * histogramWidth / peak)
+		}
+		bar := strings.Repeat("█", width)
+		fmt.Printf("%s %s %s\n", colorize(t.Format("2006-01-02 15:04"), ansiBold), bar, colorize(label(v), ansiDim))
+		t = t.Add(bucketSize)
+	}
+}
+
+// formatTimestamp renders a timestamp for reports, or "(unknown)" for the
+// zero time.
+func formatTimestamp(t time.Time) string {
+	if t.IsZero() {
+		return "(unknown)"
+	}
+	return t.Format("2006-01-02 15:04:05 -0700")
+}
+
+// incrementNested increments counts[outer][inner], creating the inner map
+// on first use.
+func incrementNested(counts map[string]map[string]int, outer, inner string) {
+	m := counts[outer]
+	if m == nil {
+		m = make(map[string]int)
+		counts[outer] = m
+	}
+	m[inner]++
+}
+
+// describeFormats writes the active formats, in the order they are tried,
+// with the LogEntry field each named capture group fills.
+func (la *LogAnalyzer) describeFormats(w io.Writer) {
+	fmt.Fprintln(w, "Active log formats, tried in order:")
+	fmt.Fprintln(w, "  W3C extended (IIS) lines, with the columns of the last #Fields: directive")
+	if la.fastParse {
+		fmt.Fprintln(w, "  fast split parser for combined lines (same result as the combined regex)")
+	}
+	for _, f := range la.formats {
+		fmt.Fprintf(w, "  %s: %s\n", f.name, f.regex.String())
+		for _, field := range []struct {
+			name  string
+			index int
+		}{
+			{"VHost", f.vhost},
+			{"IP", f.ip},
+			{"Ident", f.ident},
+			{"User", f.user},
+			{"Method", f.method},
+			{"Path", f.path},
+			{"Protocol", f.protocol},
+			{"StatusCode", f.status},
+			{"Bytes", f.bytes},
+			{"Referer", f.referer},
+			{"UserAgent", f.agent},
+			{"Timestamp", f.time},
+			{"Duration", f.duration},
+		} {
+			if field.index < 0 {
+				fmt.Fprintf(w, "    %-10s not captured\n", field.name)
+				continue
+			}
+			fmt.Fprintf(w, "    %-10s group %d (%s)\n", field.name, field.index, f.regex.SubexpNames()[field.index])
+		}
+		if f.time < 0 {
+			fmt.Fprintln(w, "    (Timestamp is read from the first [...] field)")
+		}
+	}
+}
+
+// explainLine writes what parseLine extracted from a single line.
+func explainLine(w io.Writer, lineNo int, line string, entry LogEntry, format string, ok bool) {
+	if !ok {
+		fmt.Fprintf(w, "line %d: no match: %q\n", lineNo, line)
+		return
+	}
+	fmt.Fprintf(w, "line %d: matched %s: vhost=%q ip=%q ident=%q user=%q method=%q path=%q protocol=%q status=%q bytes=%d referer=%q agent=%q time=%q\n",
+		lineNo, format, entry.VHost, entry.IP, entry.Ident, entry.User, entry.Method, entry.Path, entry.Protocol, entry.StatusCode, entry.Bytes, entry.Referer, entry.UserAgent, formatTimestamp(entry.Timestamp))
+}
+
+// parseLine extracts a LogEntry from a single line and reports which format
+// it matched. The split-based parser handles well-formed combined lines;
+// anything it is unsure about falls through la.formats in order.
+func (la *LogAnalyzer) parseLine(line string) (LogEntry, string, bool) {
+	if la.w3c != nil {
+		if entry, ok := la.w3c.parse(line); ok {
+			return entry, formatW3C, true
+		}
+	}
+	if la.fastParse {
+		if entry, ok := splitParse(line); ok {
+			entry.Timestamp = findTimestamp(line)
+			return entry, formatCombined, true
+		}
+	}
+
+	for _, f := range la.formats {
+		if entry, ok := f.parse(line); ok {
+			return entry, f.name, true
+		}
+	}
+	return LogEntry{}, "", false
+}
+
+// w3cFormat is a W3C extended log format, as written by IIS: space
+// separated columns named by a "#Fields:" directive, e.g.
+//
+//	#Fields: date time c-ip cs-method cs-uri-stem cs-uri-query sc-status sc-bytes cs(User-Agent)
+type w3cFormat struct {
+	// columns maps each field name to its column.
+	columns map[string]int
+}
+
+// directive handles a W3C "#..." directive line, reporting whether line is
+// one. A #Fields: directive sets the columns of the lines that follow;
+// the others, such as #Software or #Date, are ignored.
+func (la *LogAnalyzer) directive(line string) bool {
+	if !strings.HasPrefix(line, "#") {
+		return false
+	}
+	if names, ok := strings.CutPrefix(line, "#Fields:"); ok {
+		f := &w3cFormat{columns: make(map[string]int)}
+		for i, name := range strings.Fields(names) {
+			f.columns[name] = i
+		}
+		la.w3c = f
+	}
+	return true
+}
+
+// parse extracts a LogEntry from a line with one value per column. It
+// needs the c-ip, cs-uri-stem and sc-status columns; "+" in the user agent
+// and referrer, which IIS writes for spaces, is turned back into spaces.
+func (f *w3cFormat) parse(line string) (LogEntry, bool) {
+	values := strings.Fields(line)
+	if len(values) != len(f.columns) {
+		return LogEntry{}, false
+	}
+	get := func(name string) string {
+		if i, ok := f.columns[name]; ok {
+			return values[i]
+		}
+		return ""
+	}
+	entry := LogEntry{
+		VHost:      get("cs-host"),
+		IP:         get("c-ip"),
+		User:       get("cs-username"),
+		Method:     get("cs-method"),
+		Path:       get("cs-uri-stem"),
+		Protocol:   get("cs-version"),
+		StatusCode: get("sc-status"),
+		Bytes:      parseBytes(get("sc-bytes")),
+		Referer:    strings.ReplaceAll(get("cs(Referer)"), "+", " "),
+		UserAgent:  strings.ReplaceAll(get("cs(User-Agent)"), "+", " "),
+		Duration:   -1,
+	}
+	if entry.IP == "" || entry.Path == "" || entry.StatusCode == "" || !isDigit(entry.StatusCode[0]) {
+		return LogEntry{}, false
+	}
+	if query := get("cs-uri-query"); query != "" && query != "-" {
+		entry.Path += "?" + query
+	}
+	if t, err := time.Parse("2006-01-02 15:04:05", get("date")+" "+get("time")); err == nil {
+		entry.Timestamp = validTimestamp(t)
+	}
+	if ms, err := strconv.ParseInt(get("time-taken"), 10, 64); err == nil {
+		entry.Duration = ms * 1000
+	}
+	return entry, true
+}
+
+// parseBytes converts a response size field, returning -1 when it is
+// missing, "-" or not a number.
+func parseBytes(field string) int64 {
+	n, err := strconv.ParseInt(field, 10, 64)
+	if err != nil {
+		return -1
+	}
+	return n
+}
+
+// parseDuration converts a request duration field to microseconds,
+// returning -1 when it is "-" or malformed. Integers are taken as
+// microseconds, like Apache's %D; values with a decimal point as seconds,
+// like nginx's $request_time.
+func parseDuration(field string) int64 {
+	if strings.Contains(field, ".") {
+		secs, err := strconv.ParseFloat(field, 64)
+		if err != nil || secs < 0 {
+			return -1
+		}
+		return int64(math.Round(secs * 1e6))
+	}
+	us, err := strconv.ParseInt(field, 10, 64)
+	if err != nil || us < 0 {
+		return -1
+	}
+	return us
+}
+
+// isSpace reports whether c is in the regex \s class.
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\f' || c == '\r'
+}
+
+// isDigit reports whether c is in the regex \d class.
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// requestMethods are the methods accepted in the request line, in any case,
+// matching logRegex.
+var requestMethods = []string{"GET", "POST", "PUT", "DELETE", "HEAD", "OPTIONS"}
+
+// splitParse walks the line with plain index scans instead of the lazy
+// quantifiers in logRegex. At every step it takes the same choice the regex
+// would try first, and it gives up (ok == false) as soon as that choice
+// fails, so whenever it succeeds the result is identical to the regex match.
+func splitParse(line string) (LogEntry, bool) {
+	// 1. IP address: everything up to the first whitespace.
+	i := 0
+	for i < len(line) && !isSpace(line[i]) {
+		i++
+	}
+	if i == 0 {
+		return LogEntry{}, false
+	}
+	ip := line[:i]
+
+	// Ident and user, if the IP is followed by two tokens and a "[", each
+	// after a single whitespace. Tokens with a quote are left to the regex.
+	ident, user := "", ""
+	if j := i; j < len(line) && isSpace(line[j]) {
+		k := j + 1
+		for k < len(line) && !isSpace(line[k]) {
+			k++
+		}
+		if k > j+1 && k < len(line) {
+			m := k + 1
+			for m < len(line) && !isSpace(line[m]) {
+				m++
+			}
+			if m > k+1 && m+1 < len(line) && line[m+1] == '[' {
+				ident, user = line[j+1:k], line[k+1:m]
+				if strings.Contains(line[j:m], `"`) {
+					return LogEntry{}, false
+				}
+			}
+		}
+	}
+
+	// 2. First quote that opens a request line with a known method. The
+	// regex folds case the Unicode way, where "ſ" matches "S", so non-ASCII
+	// bytes where a method could be are left to it.
+	pathStart, method := -1, ""
+	for pathStart < 0 {
+		q := strings.IndexByte(line[i:], '"')
+		if q < 0 {
+			return LogEntry{}, false
+		}
+		i += q + 1
+		for _, c := range []byte(line[i:min(len(line), i+len("OPTIONS")+1)]) {
+			if c >= utf8.RuneSelf {
+				return LogEntry{}, false
+			}
+		}
+		for _, m := range requestMethods {
+			if i+len(m) < len(line) && strings.EqualFold(line[i:i+len(m)], m) && isSpace(line[i+len(m)]) {
+				pathStart, method = i+len(m)+1, line[i:i+len(m)]
+				break
+			}
+		}
+	}
+
+	// Request path: everything up to the next whitespace.
+	i = pathStart
+	for i < len(line) && !isSpace(line[i]) {
+		i++
+	}
+	if i == pathStart {
+		return LogEntry{}, false
+	}
+	path := line[pathStart:i]
+
+	// Protocol, if present: whitespace followed by a token without quotes.
+	protocol := ""
+	if i < len(line) && isSpace(line[i]) {
+		j := i + 1
+		for j < len(line) && !isSpace(line[j]) && line[j] != '"' {
+			j++
+		}
+		protocol = line[i+1 : j]
+	}
+
+	// 3. Status code: first quote followed by whitespace and digits.
+	statusStart := -1
+	for statusStart < 0 {
+		q := strings.IndexByte(line[i:], '"')
+		if q < 0 {
+			return LogEntry{}, false
+		}
+		i += q + 1
+		if i+1 < len(line) && isSpace(line[i]) && isDigit(line[i+1]) {
+			statusStart = i + 1
+		}
+	}
+	i = statusStart
+	for i < len(line) && isDigit(line[i]) {
+		i++
+	}
+	status := line[statusStart:i]
+
+	// Response size, if present: whitespace followed by digits or "-".
+	bytesField := ""
+	if i+1 < len(line) && isSpace(line[i]) {
+		j := i + 1
+		for j < len(line) && isDigit(line[j]) {
+			j++
+		}
+		if j > i+1 {
+			bytesField = line[i+1 : j]
+			i = j
+		} else if line[i+1] == '-' {
+			bytesField = "-"
+			i += 2
+		}
+	}
+
+	// 4. Referrer ("-" or a token without whitespace) and user agent.
+	q := strings.IndexByte(line[i:], '"')
+	if q < 0 {
+		return LogEntry{}, false
+	}
+	i += q + 1
+	var referer string
+	if strings.HasPrefix(line[i:], `-"`) {
+		referer = "-"
+		i += 2
+	} else {
+		end := i
+		for end < len(line) && !isSpace(line[end]) {
+			end++
+		}
+		if end-i < 2 || line[end-1] != '"' {
+			return LogEntry{}, false
+		}
+		referer = line[i : end-1]
+		i = end
+	}
+	wsStart := i
+	for i < len(line) && isSpace(line[i]) {
+		i++
+	}
+	if i == wsStart || i >= len(line) || line[i] != '"' {
+		return LogEntry{}, false
+	}
+	agentStart := i + 1
+	if agentStart >= len(line) {
+		return LogEntry{}, false
+	}
+	q = strings.IndexByte(line[agentStart+1:], '"')
+	if q < 0 {
+		return LogEntry{}, false
+	}
+	agent := line[agentStart : agentStart+1+q]
+
+	return LogEntry{
+		IP:         ip,
+		Ident:      ident,
+		User:       user,
+		Method:     method,
+		Path:       path,
+		Protocol:   protocol,
+		StatusCode: status,
+		Bytes:      parseBytes(bytesField),
+		Referer:    referer,
+		UserAgent:  agent,
+		Duration:   -1,
+	}, true
+}
+
+// getTopN converts a count map into a sorted slice of ResultItem and returns the top N
+// (all items when n is 0), by count descending and then by value.
+// It also accepts byte totals, which are ranked the same way.
+// When n is smaller than the map, only the top n are kept, in a bounded
+// heap, rather than sorting every item.
+func getTopN[V int | int64](counts map[string]V, n int) []ResultItem {
+	if n <= 0 || n >= len(counts) {
+		var results []ResultItem
+		for val, count := range counts {
+			results = append(results, ResultItem{Value: val, Count: int(count)})
+		}
+		sort.Slice(results, func(i, j int) bool {
+			return rankedBefore(results[i], results[j])
+		})
+		return results
+	}
+
+	// h holds the best n items seen so far, the worst of them at the root.
+	h := make(resultHeap, 0, n)
+	for val, count := range counts {
+		item := ResultItem{Value: val, Count: int(count)}
+		if len(h) < n {
+			heap.Push(&h, item)
+		} else if rankedBefore(item, h[0]) {
+			h[0] = item
+			heap.Fix(&h, 0)
+		}
+	}
+	results := make([]ResultItem, len(h))
+	for i := len(results) - 1; i >= 0; i-- {
+		results[i] = heap.Pop(&h).(ResultItem)
+	}
+	return results
+}
+
+// rankedBefore reports whether a comes before b in getTopN results: it has
+// the larger count, or the same count and the smaller value.
+func rankedBefore(a, b ResultItem) bool {
+	if a.Count != b.Count {
+		return a.Count > b.Count
+	}
+	return a.Value < b.Value
+}
+
+// resultHeap is a min-heap of ResultItem by rankedBefore: the item ranked
+// last is at the root.
+type resultHeap []ResultItem
+
+func (h resultHeap) Len() int           { return len(h) }
+func (h resultHeap) Less(i, j int) bool { return rankedBefore(h[j], h[i]) }
+func (h resultHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *resultHeap) Push(x any)        { *h = append(*h, x.(ResultItem)) }
+func (h *resultHeap) Pop() any {
+	old := *h
+	item := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return item
+}
+
+// topTracker counts the most frequent keys of a stream in memory bounded
+// by its capacity, with the Space-Saving algorithm: once capacity keys are
+// tracked, a new key takes over the slot of the least counted one and
+// inherits its count. Counts are thus upper bounds, off by at most the
+// smallest tracked count, and any key more frequent than that is tracked.
+type topTracker struct {
+	capacity int
+	slots    topHeap
+	index    map[string]*topSlot
+}
+
+// topSlot is a tracked key and its position in the heap.
+type topSlot struct {
+	key   string
+	count int
+	pos   int
+}
+
+// topHeap is a min-heap of slots by count, for container/heap.
+type topHeap []*topSlot
+
+func (h topHeap) Len() int           { return len(h) }
+func (h topHeap) Less(i, j int) bool { return h[i].count < h[j].count }
+func (h topHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].pos, h[j].pos = i, j
+}
+func (h *topHeap) Push(x any) {
+	s := x.(*topSlot)
+	s.pos = len(*h)
+	*h = append(*h, s)
+}
+func (h *topHeap) Pop() any {
+	old := *h
+	s := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return s
+}
+
+// newTopTracker returns a tracker keeping at most capacity keys.
+func newTopTracker(capacity int) *topTracker {
+	return &topTracker{capacity: capacity, index: make(map[string]*topSlot, capacity)}
+}
+
+// add counts n more occurrences of key.
+func (t *topTracker) add(key string, n int) {
+	if s := t.index[key]; s != nil {
+		s.count += n
+		heap.Fix(&t.slots, s.pos)
+		return
+	}
+	if len(t.slots) < t.capacity {
+		s := &topSlot{key: key, count: n}
+		heap.Push(&t.slots, s)
+		t.index[key] = s
+		return
+	}
+	s := t.slots[0]
+	delete(t.index, s.key)
+	s.key = key
+	s.count += n
+	t.index[key] = s
+	heap.Fix(&t.slots, 0)
+}
+
+// counts returns the tracked keys and their counts.
+func (t *topTracker) counts() map[string]int {
+	counts := make(map[string]int, len(t.slots))
+	for _, s := range t.slots {
+		counts[s.key] = s.count
+	}
+	return counts
+}
+
+// groupByPrefix aggregates path counts by their first depth path segments,
+// so that e.g. "/static/css/app.css" and "/static/js/app.js" both count
+// towards "/static" at depth 1. Query strings are ignored.
+func groupByPrefix(pathCounts map[string]int, depth int) map[string]int {
+	groups := make(map[string]int)
+	for path, count := range pathCounts {
+		segments := strings.Split(strings.Trim(stripQuery(path), "/"), "/")
+		if len(segments) > depth {
+			segments = segments[:depth]
+		}
+		groups["/"+strings.Join(segments, "/")] += count
+	}
+	return groups
+}
+
+// category is a named count map. name is used for -output-dir file names
+// and JSON keys, label for the per-item category of CSV and NDJSON rows,
+// title for the text heading after "Top N". bytes sums the response sizes
+// of each item, and bytesTitle is the heading when ranking by them.
+type category struct {
+	name       string
+	label      string
+	title      string
+	counts     map[string]int
+	bytes      map[string]int64
+	bytesTitle string
+}
+
+// keepAtLeast leaves the items with fewer than min requests out of c,
+// returning how many there were. The count maps are copied, not changed.
+func (c *category) keepAtLeast(min int) int {
+	counts := make(map[string]int, len(c.counts))
+	var bytes map[string]int64
+	if c.bytes != nil {
+		bytes = make(map[string]int64, len(c.bytes))
+	}
+	for key, n := range c.counts {
+		if n < min {
+			continue
+		}
+		counts[key] = n
+		if b, ok := c.bytes[key]; ok {
+			bytes[key] = b
+		}
+	}
+	below := len(c.counts) - len(counts)
+	c.counts, c.bytes = counts, bytes
+	return below
+}
+
+// topByBytes returns the n items of c that served the most bytes, with
+// their request counts and byte totals.
+func (c category) topByBytes(n int) []ResultItem {
+	items := getTopN(c.bytes, n)
+	for i := range items {
+		items[i].Bytes = int64(items[i].Count)
+		items[i].Count = c.counts[items[i].Value]
+	}
+	return items
+}
+
+// categoryNames are the names of the report categories in output order.
+var categoryNames = []string{"ips", "paths", "status", "agents"}
+
+// categories lists the report categories in output order, leaving out
+// those showsCategory rejects.
+func (la *LogAnalyzer) categories() []category {
+	all := []category{
+		{name: "ips", label: "ip", title: "IP addresses with the most requests", counts: la.ipCounts,
+			bytes: la.ipBytes, bytesTitle: "IP addresses by bandwidth"},
+		{name: "paths", label: "path", title: "most requested paths", counts: la.pathCounts,
+			bytes: la.pathBytes, bytesTitle: "paths by bandwidth"},
+		{name: "status", label: "status", title: "response status codes", counts: la.statusCounts,
+			bytes: la.bytesPerStatus, bytesTitle: "response status codes by bandwidth"},
+		{name: "agents", label: "agent", title: "user agents", counts: la.agentCounts,
+			bytes: la.agentBytes, bytesTitle: "user agents by bandwidth"},
+	}
+	categories := all[:0]
+	for _, c := range all {
+		if la.showsCategory(c.name) {
+			categories = append(categories, c)
+		}
+	}
+	return categories
+}
+
+// showsCategory reports whether the named category is reported: every
+// category is, unless only lists some.
+func (la *LogAnalyzer) showsCategory(name string) bool {
+	return len(la.only) == 0 || la.only[name]
+}
+
+// Layout of the -chart SVG and PNG, in pixels.
+const (
+	chartWidth      = 960
+	chartLabelWidth = 340
+	chartBarHeight  = 18
+	chartBarGap     = 6
+	chartMaxLabel   = 48 // label length in characters, longer ones are truncated
+)
+
+// chartRow is one line of a -chart: a category title, a note when the
+// category has no data, or a bar for one item. y is the top of a bar, and
+// the text baseline of titles and notes.
+type chartRow struct {
+	y           int
+	title, note string
+	item        ResultItem
+	barWidth    int
+}
+
+// chartLayout lays out the bar charts of the top n items of every
+// category, returning their rows and the height of the whole chart.
+func chartLayout(categories []category, n int) ([]chartRow, int) {
+	var rows []chartRow
+	y := 0
+	for _, c := range categories {
+		items := getTopN(c.counts, n)
+		y += 36
+		rows = append(rows, chartRow{y: y, title: topLabel(n) + " " + c.name + " by requests"})
+		y += 12
+		if len(items) == 0 {
+			y += chartBarHeight
+			rows = append(rows, chartRow{y: y - 5, note: "(no data)"})
+			continue
+		}
+		peak := items[0].Count
+		for _, item := range items {
+			rows = append(rows, chartRow{y: y, item: item, barWidth: max(1, (chartWidth-chartLabelWidth-100)*item.Count/peak)})
+			y += chartBarHeight + chartBarGap
+		}
+	}
+	return rows, y + 20
+}
+
+// writeChart writes an SVG document with a horizontal bar chart of the top
+// n items of every category.
+func writeChart(w io.Writer, categories []category, n int) error {
+	rows, height := chartLayout(categories, n)
+	var body strings.Builder
+	for _, row := range rows {
+		switch {
+		case row.title != "":
+			fmt.Fprintf(&body, "<text x=\"10\" y=\"%d\" class=\"title\">%s</text>\n", row.y, html.EscapeString(row.title))
+		case row.note != "":
+			fmt.Fprintf(&body, "<text x=\"%d\" y=\"%d\">%s</text>\n", chartLabelWidth, row.y, row.note)
+		default:
+			fmt.Fprintf(&body, "<text x=\"%d\" y=\"%d\" text-anchor=\"end\"><title>%s</title>%s</text>\n",
+				chartLabelWidth-8, row.y+chartBarHeight-5, html.EscapeString(row.item.Value), html.EscapeString(truncateLabel(row.item.Value, chartMaxLabel)))
+			fmt.Fprintf(&body, "<rect x=\"%d\" y=\"%d\" width=\"%d\" height=\"%d\" class=\"bar\"/>\n",
+				chartLabelWidth, row.y, row.barWidth, chartBarHeight)
+			fmt.Fprintf(&body, "<text x=\"%d\" y=\"%d\">%s</text>\n",
+				chartLabelWidth+row.barWidth+6, row.y+chartBarHeight-5, formatInt(row.item.Count))
+		}
+	}
+
+	_, err := fmt.Fprintf(w, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" font-family="sans-serif" font-size="12">
+<style>.title { font-size: 16px; font-weight: bold; } .bar { fill: #4e79a7; }</style>
+<rect width="100%%" height="100%%" fill="white"/>
+%s</svg>
+`, chartWidth, height, body.String())
+	return err
+}
+
+// chartBarColor is the fill of the -chart bars, #4e79a7 as in the SVG.
+var chartBarColor = color.RGBA{0x4e, 0x79, 0xa7, 0xff}
+
+// writeChartPNG writes the bar charts of writeChart as a PNG image. Text
+// is drawn with the built-in 5x7 pixelFont, titles at twice the size.
+func writeChartPNG(w io.Writer, categories []category, n int) error {
+	rows, height := chartLayout(categories, n)
+	img := image.NewRGBA(image.Rect(0, 0, chartWidth, height))
+	draw.Draw(img, img.Bounds(), image.White, image.Point{}, draw.Src)
+	for _, row := range rows {
+		switch {
+		case row.title != "":
+			drawText(img, 10, row.y, row.title, 2)
+		case row.note != "":
+			drawText(img, chartLabelWidth, row.y, row.note, 1)
+		default:
+			// pixelFont is ASCII only, so the ellipsis of a cut label is
+			// drawn as three dots.
+			label := strings.ReplaceAll(truncateLabel(row.item.Value, chartMaxLabel), "…", "...")
+			drawText(img, chartLabelWidth-8-textWidth(label, 1), row.y+chartBarHeight-5, label, 1)
+			bar := image.Rect(chartLabelWidth, row.y, chartLabelWidth+row.barWidth, row.y+chartBarHeight)
+			draw.Draw(img, bar, image.NewUniform(chartBarColor), image.Point{}, draw.Src)
+			drawText(img, chartLabelWidth+row.barWidth+6, row.y+chartBarHeight-5, formatInt(row.item.Count), 1)
+		}
+	}
+	return png.Encode(w, img)
+}
+
+// textWidth is the width in pixels of s drawn by drawText at scale.
+func textWidth(s string, scale int) int {
+	return utf8.RuneCountInString(s) * 6 * scale
+}
+
+// drawText draws s in black with pixelFont, each pixel scale pixels wide,
+// starting at x with its baseline at y. Runes the font lacks are drawn as
+// "?".
+func drawText(img *image.RGBA, x, y int, s string, scale int) {
+	top := y - 7*scale
+	for _, r := range s {
+		if r < ' ' || r > '~' {
+			r = '?'
+		}
+		for col, bits := range pixelFont[r-' '] {
+			for row := 0; row < 7; row++ {
+				if bits&(1<<row) == 0 {
+					continue
+				}
+				px := image.Rect(x+col*scale, top+row*scale, x+(col+1)*scale, top+(row+1)*scale)
+				draw.Draw(img, px, image.Black, image.Point{}, draw.Src)
+			}
+		}
+		x += 6 * scale
+	}
+}
+
+// pixelFont is a 5x7 bitmap font for the printable ASCII characters, from
+// ' ' to '~'. Each glyph is five columns, left to right, with the top
+// pixel in the lowest bit.
+var pixelFont = [95][5]byte{
+	{0x00, 0x00, 0x00, 0x00, 0x00}, // ' '
+	{0x00, 0x00, 0x5f, 0x00, 0x00}, // !
+	{0x00, 0x07, 0x00, 0x07, 0x00}, // "
+	{0x14, 0x7f, 0x14, 0x7f, 0x14}, // #
+	{0x24, 0x2a, 0x7f, 0x2a, 0x12}, // $
+	{0x23, 0x13, 0x08, 0x64, 0x62}, // %
+	{0x36, 0x49, 0x55, 0x22, 0x50}, // &
+	{0x00, 0x05, 0x03, 0x00, 0x00}, // '
+	{0x00, 0x1c, 0x22, 0x41, 0x00}, // (
+	{0x00, 0x41, 0x22, 0x1c, 0x00}, // )
+	{0x14, 0x08, 0x3e, 0x08, 0x14}, // *
+	{0x08, 0x08, 0x3e, 0x08, 0x08}, // +
+	{0x00, 0x50, 0x30, 0x00, 0x00}, // ,
+	{0x08, 0x08, 0x08, 0x08, 0x08}, // -
+	{0x00, 0x60, 0x60, 0x00, 0x00}, // .
+	{0x20, 0x10, 0x08, 0x04, 0x02}, // /
+	{0x3e, 0x51, 0x49, 0x45, 0x3e}, // 0
+	{0x00, 0x42, 0x7f, 0x40, 0x00}, // 1
+	{0x42, 0x61, 0x51, 0x49, 0x46}, // 2
+	{0x21, 0x41, 0x45, 0x4b, 0x31}, // 3
+	{0x18, 0x14, 0x12, 0x7f, 0x10}, // 4
+	{0x27, 0x45, 0x45, 0x45, 0x39}, // 5
+	{0x3c, 0x4a, 0x49, 0x49, 0x30}, // 6
+	{0x01, 0x71, 0x09, 0x05, 0x03}, // 7
+	{0x36, 0x49, 0x49, 0x49, 0x36}, // 8
+	{0x06, 0x49, 0x49, 0x29, 0x1e}, // 9
+	{0x00, 0x36, 0x36, 0x00, 0x00}, // :
+	{0x00, 0x56, 0x36, 0x00, 0x00}, // ;
+	{0x08, 0x14, 0x22, 0x41, 0x00}, // <
+	{0x14, 0x14, 0x14, 0x14, 0x14}, // =
+	{0x00, 0x41, 0x22, 0x14, 0x08}, // >
+	{0x02, 0x01, 0x51, 0x09, 0x06}, // ?
+	{0x32, 0x49, 0x79, 0x41, 0x3e}, // @
+	{0x7e, 0x11, 0x11, 0x11, 0x7e}, // A
+	{0x7f, 0x49, 0x49, 0x49, 0x36}, // B
+	{0x3e, 0x41, 0x41, 0x41, 0x22}, // C
+	{0x7f, 0x41, 0x41, 0x22, 0x1c}, // D
+	{0x7f, 0x49, 0x49, 0x49, 0x41}, // E
+	{0x7f, 0x09, 0x09, 0x09, 0x01}, // F
+	{0x3e, 0x41, 0x49, 0x49, 0x7a}, // G
+	{0x7f, 0x08, 0x08, 0x08, 0x7f}, // H
+	{0x00, 0x41, 0x7f, 0x41, 0x00}, // I
+	{0x20, 0x40, 0x41, 0x3f, 0x01}, // J
+	{0x7f, 0x08, 0x14, 0x22, 0x41}, // K
+	{0x7f, 0x40, 0x40, 0x40, 0x40}, // L
+	{0x7f, 0x02, 0x0c, 0x02, 0x7f}, // M
+	{0x7f, 0x04, 0x08, 0x10, 0x7f}, // N
+	{0x3e, 0x41, 0x41, 0x41, 0x3e}, // O
+	{0x7f, 0x09, 0x09, 0x09, 0x06}, // P
+	{0x3e, 0x41, 0x51, 0x21, 0x5e}, // Q
+	{0x7f, 0x09, 0x19, 0x29, 0x46}, // R
+	{0x46, 0x49, 0x49, 0x49, 0x31}, // S
+	{0x01, 0x01, 0x7f, 0x01, 0x01}, // T
+	{0x3f, 0x40, 0x40, 0x40, 0x3f}, // U
+	{0x1f, 0x20, 0x40, 0x20, 0x1f}, // V
+	{0x3f, 0x40, 0x38, 0x40, 0x3f}, // W
+	{0x63, 0x14, 0x08, 0x14, 0x63}, // X
+	{0x07, 0x08, 0x70, 0x08, 0x07}, // Y
+	{0x61, 0x51, 0x49, 0x45, 0x43}, // Z
+	{0x00, 0x7f, 0x41, 0x41, 0x00}, // [
+	{0x02, 0x04, 0x08, 0x10, 0x20}, // \
+	{0x00, 0x41, 0x41, 0x7f, 0x00}, // ]
+	{0x04, 0x02, 0x01, 0x02, 0x04}, // ^
+	{0x40, 0x40, 0x40, 0x40, 0x40}, // _
+	{0x00, 0x01, 0x02, 0x04, 0x00}, // `
+	{0x20, 0x54, 0x54, 0x54, 0x78}, // a
+	{0x7f, 0x48, 0x44, 0x44, 0x38}, // b
+	{0x38, 0x44, 0x44, 0x44, 0x20}, // c
+	{0x38, 0x44, 0x44, 0x48, 0x7f}, // d
+	{0x38, 0x54, 0x54, 0x54, 0x18}, // e
+	{0x08, 0x7e, 0x09, 0x01, 0x02}, // f
+	{0x0c, 0x52, 0x52, 0x52, 0x3e}, // g
+	{0x7f, 0x08, 0x04, 0x04, 0x78}, // h
+	{0x00, 0x44, 0x7d, 0x40, 0x00}, // i
+	{0x20, 0x40, 0x44, 0x3d, 0x00}, // j
+	{0x7f, 0x10, 0x28, 0x44, 0x00}, // k
+	{0x00, 0x41, 0x7f, 0x40, 0x00}, // l
+	{0x7c, 0x04, 0x18, 0x04, 0x78}, // m
+	{0x7c, 0x08, 0x04, 0x04, 0x78}, // n
+	{0x38, 0x44, 0x44, 0x44, 0x38}, // o
+	{0x7c, 0x14, 0x14, 0x14, 0x08}, // p
+	{0x08, 0x14, 0x14, 0x18, 0x7c}, // q
+	{0x7c, 0x08, 0x04, 0x04, 0x08}, // r
+	{0x48, 0x54, 0x54, 0x54, 0x20}, // s
+	{0x04, 0x3f, 0x44, 0x40, 0x20}, // t
+	{0x3c, 0x40, 0x40, 0x20, 0x7c}, // u
+	{0x1c, 0x20, 0x40, 0x20, 0x1c}, // v
+	{0x3c, 0x40, 0x30, 0x40, 0x3c}, // w
+	{0x44, 0x28, 0x10, 0x28, 0x44}, // x
+	{0x0c, 0x50, 0x50, 0x50, 0x3c}, // y
+	{0x44, 0x64, 0x54, 0x4c, 0x44}, // z
+	{0x00, 0x08, 0x36, 0x41, 0x00}, // {
+	{0x00, 0x00, 0x7f, 0x00, 0x00}, // |
+	{0x00, 0x41, 0x36, 0x08, 0x00}, // }
+	{0x08, 0x04, 0x08, 0x10, 0x08}, // ~
+}
+
+// truncateLabel shortens s to at most n characters, marking the cut with
+// an ellipsis.
+func truncateLabel(s string, n int) string {
+	runes := []rune(s)
+	if len(runes) <= n {
+		return s
+	}
+	return string(runes[:n-1]) + "…"
+}
+
+// categoryFileFormats are the -output-format values.
+var categoryFileFormats = []string{"csv", "json", "ndjson", "xml"}
+
+// writeCategoryFiles writes the full counts of every category to
+// <dir>/<category>.<format>, creating dir if it does not exist.
+func writeCategoryFiles(dir, format string, categories []category) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("error creating output directory: %w", err)
+	}
+
+	for _, c := range categories {
+		if err := writeCategoryFile(filepath.Join(dir, c.name+"."+format), format, c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeCategoryFile writes the full counts of c to a single file as CSV,
+// JSON, NDJSON or XML.
+func writeCategoryFile(path, format string, c category) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("error creating %s: %w", path, err)
+	}
+
+	total := sumCounts(c.counts)
+	results := withPercent(getTopN(c.counts, 0), total)
+	switch format {
+	case "csv":
+		err = writeCSV(f, results)
+	case "json":
+		err = writeJSON(f, results)
+	case "ndjson":
+		err = writeNDJSON(f, results)
+	case "xml":
+		err = writeXML(f, CategoryResults{Label: c.label, Total: total, Items: results})
+	default:
+		err = fmt.Errorf("unsupported output format %q", format)
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("error writing %s: %w", path, err)
+	}
+	return nil
+}
+
+// writeCSV writes results as value,count rows with a header line.
+func writeCSV(w io.Writer, results []ResultItem) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write([]string{"value", "count"}); err != nil {
+		return err
+	}
+	for _, item := range results {
+		if err := cw.Write([]string{item.Value, strconv.Itoa(item.Count)}); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// writeJSON writes results as an indented JSON array.
+func writeJSON(w io.Writer, results []ResultItem) error {
+	if results == nil {
+		results = []ResultItem{}
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(results)
+}
+
+// writeNDJSON writes results as one JSON object per line.
+func writeNDJSON(w io.Writer, results []ResultItem) error {
+	enc := json.NewEncoder(w)
+	for _, item := range results {
+		if err := enc.Encode(item); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeXML writes the results of one category as an XML document, e.g.
+// <category name="ip" total="..."><item>...</item></category>.
+func writeXML(w io.Writer, c CategoryResults) error {
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.EncodeElement(c, xml.StartElement{Name: xml.Name{Local: "category"}}); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+// printTopErrors prints the n paths with the most error responses, each
+// followed by its breakdown by status code, e.g.
+// "/api/x - 300 errors [404:250, 500:50]".
+func printTopErrors(title string, errorPathStatus map[string]map[string]int, n int) {
+	printBreakdown(title, errorPathStatus, n, 0, "errors")
+}
+
+// printBreakdown prints the n outer keys of a nested count map with the
+// largest totals, each followed by its top inner keys (all of them when
+// inner is 0). unit names what is counted, e.g. "requests".
+func printBreakdown(title string, nested map[string]map[string]int, n, inner int, unit string) {
+	totals := make(map[string]int, len(nested))
+	for outer, counts := range nested {
+		for _, count := range counts {
+			totals[outer] += count
+		}
+	}
+
+	fmt.Printf("\n%s:\n", title)
+	for _, item := range getTopN(totals, n) {
+		var parts []string
+		for _, s := range getTopN(nested[item.Value], inner) {
+			parts = append(parts, fmt.Sprintf("%s:%s", s.Value, formatInt(s.Count)))
+		}
+		if more := len(nested[item.Value]) - len(parts); more > 0 {
+			parts = append(parts, "+"+formatInt(more)+" more")
+		}
+		value := colorize(item.Value, ansiBold)
+		count := colorize(formatInt(item.Count)+" "+unit, ansiDim)
+		fmt.Printf("%s - %s [%s]\n", value, count, strings.Join(parts, ", "))
+	}
+}
+
+// pathScore is a path ranked by importanceScores.
+type pathScore struct {
+	Path     string
+	Requests int
+	Errors   int
+	Score    float64
+}
+
+// importanceScores ranks paths that returned errors by
+// score = requests * errorRate^weight. With weight 1 the score is simply the
+// error count; larger weights favour endpoints that fail consistently over
+// busy endpoints that fail occasionally.
+func (la *LogAnalyzer) importanceScores(weight float64) []pathScore {
+	scores := make([]pathScore, 0, len(la.errorPathStatus))
+	for path, byStatus := range la.errorPathStatus {
+		// Under -approx-top, paths dropped from pathCounts have no request
+		// total to score against.
+		requests, ok := la.pathCounts[path]
+		if !ok || requests == 0 {
+			continue
+		}
+		ps := pathScore{Path: path, Requests: requests}
+		for _, count := range byStatus {
+			ps.Errors += count
+		}
+		errorRate := float64(ps.Errors) / float64(ps.Requests)
+		ps.Score = float64(ps.Requests) * math.Pow(errorRate, weight)
+		scores = append(scores, ps)
+	}
+
+	sort.Slice(scores, func(i, j int) bool {
+		return scores[i].Score > scores[j].Score
+	})
+	return scores
+}
+
+// printImportance prints the top n scored paths.
+func printImportance(title string, scores []pathScore, n int) {
+	if len(scores) > n {
+		scores = scores[:n]
+	}
+	fmt.Printf("\n%s:\n", title)
+	for _, ps := range scores {
+		value := colorize(ps.Path, ansiBold)
+		detail := colorize(fmt.Sprintf("score %s (%s requests, %s errors)",
+			formatFloat(ps.Score), formatInt(ps.Requests), formatPercent(float64(ps.Errors)*100/float64(ps.Requests))), ansiDim)
+		fmt.Printf("%s - %s\n", value, detail)
+	}
+}
+
+// Display settings for numbers in text reports, set from -number-format,
+// -thousands-sep and -precision in main. File outputs always use raw
+// numbers.
+var (
+	thousandsSep string
+	decimalSep   = "."
+	precision    = 2
+)
+
+// numberFormats are the -number-format presets: the digit group separator
+// and the decimal separator.
+var numberFormats = map[string][2]string{
+	"plain": {"", "."},
+	"comma": {",", "."},
+	"space": {" ", ","},
+}
+
+// formatInt renders n with thousandsSep between groups of three digits.
+func formatInt(n int) string {
+	return groupThousands(strconv.Itoa(n))
+}
+
+// formatFloat renders f with the configured precision, grouping the
+// integer part like formatInt.
+func formatFloat(f float64) string {
+	s := strconv.FormatFloat(f, 'f', precision, 64)
+	intPart, frac := s, ""
+	if i := strings.IndexByte(s, '.'); i >= 0 {
+		intPart, frac = s[:i], decimalSep+s[i+1:]
+	}
+	return groupThousands(intPart) + frac
+}
+
+// formatPercent renders a percentage value such as 12.5 as "12.50%".
+func formatPercent(pct float64) string {
+	return formatFloat(pct) + "%"
+}
+
+// formatSignedPercent renders a change in percent with its sign, e.g.
+// "+12.50%".
+func formatSignedPercent(pct float64) string {
+	if pct >= 0 {
+		return "+" + formatPercent(pct)
+	}
+	return formatPercent(pct)
+}
+
+// formatPoints renders a difference of percentages, with its sign, e.g.
+// "+1.50 points".
+func formatPoints(d float64) string {
+	if d >= 0 {
+		return "+" + formatFloat(d) + " points"
+	}
+	return formatFloat(d) + " points"
+}
+
+// groupThousands inserts thousandsSep into a string of digits, which may
+// start with a minus sign.
+func groupThousands(digits string) string {
+	if thousandsSep == "" {
+		return digits
+	}
+	sign := ""
+	if strings.HasPrefix(digits, "-") {
+		sign, digits = "-", digits[1:]
+	}
+	if len(digits) <= 3 {
+		return sign + digits
+	}
+
+	var b strings.Builder
+	b.WriteString(sign)
+	head := len(digits) % 3
+	if head > 0 {
+		b.WriteString(digits[:head])
+	}
+	for i := head; i < len(digits); i += 3 {
+		if b.Len() > len(sign) {
+			b.WriteString(thousandsSep)
+		}
+		b.WriteString(digits[i : i+3])
+	}
+	return b.String()
+}
+
+// ANSI escape codes used when color output is enabled.
+const (
+	ansiReset  = "\033[0m"
+	ansiBold   = "\033[1m"
+	ansiDim    = "\033[2m"
+	ansiRed    = "\033[31m"
+	ansiGreen  = "\033[32m"
+	ansiYellow = "\033[33m"
+)
+
+// useColor enables ANSI coloring of the printed reports. It is set from the
+// -color flag in main.
+var useColor bool
+
+// colorEnabled resolves a -color mode (auto, always or never) into whether
+// color should be used. In auto mode color is only used when stdout is a
+// terminal, so redirected output stays plain.
+func colorEnabled(mode string) (bool, error) {
+	switch mode {
+	case "always":
+		return true, nil
+	case "never":
+		return false, nil
+	case "auto":
+		info, err := os.Stdout.Stat()
+		if err != nil {
+			return false, nil
+		}
+		return info.Mode()&os.ModeCharDevice != 0, nil
+	default:
+		return false, fmt.Errorf("invalid -color value %q (want auto, always or never)", mode)
+	}
+}
+
+// colorize wraps s in the given ANSI codes when color is enabled.
+func colorize(s string, codes ...string) string {
+	if !useColor || len(codes) == 0 {
+		return s
+	}
+	return strings.Join(codes, "") + s + ansiReset
+}
+
+// statusColor picks the color for a status code by its class:
+// green for 2xx, yellow for 3xx/4xx and red for 5xx.
+func statusColor(code string) string {
+	if code == "" {
+		return ""
+	}
+	switch code[0] {
+	case '2':
+		return ansiGreen
+	case '3', '4':
+		return ansiYellow
+	case '5':
+		return ansiRed
+	}
+	return ""
+}
+
+// entryHost returns the lowercased host a request was for: its vhost
+// field, or else the host of an absolute request URL. It is "" when the
+// log records neither.
+func entryHost(entry LogEntry) string {
+	if entry.VHost != "" {
+		return strings.ToLower(entry.VHost)
+	}
+	return requestHost(entry.Path)
+}
+
+// requestHost returns the host of an absolute request URL, as logged by
+// forward proxies, or "" for the relative paths of ordinary server logs.
+func requestHost(path string) string {
+	if !strings.Contains(path, "://") {
+		return ""
+	}
+	u, err := url.Parse(path)
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(u.Hostname())
+}
+
+// groupReferrers aggregates referrer counts by the registrable domain of
+// each referrer URL (see referrerDomain).
+func groupReferrers(refererCounts map[string]int) map[string]int {
+	groups := make(map[string]int)
+	for referer, count := range refererCounts {
+		groups[referrerDomain(referer)] += count
+	}
+	return groups
+}
+
+// referrerDomain returns the registrable domain of a referrer URL, e.g.
+// "google.com" for "https://www.google.com/search?q=x". Without a public
+// suffix list it keeps the last two host labels, or three when the last two
+// look like a country second-level domain (co.uk, com.au). IP addresses are
+// kept whole, and values that are not URLs, such as noneKey, are returned
+// unchanged.
+func referrerDomain(referer string) string {
+	u, err := url.Parse(referer)
+	if err != nil || u.Hostname() == "" {
+		return referer
+	}
+	host := strings.ToLower(u.Hostname())
+	if net.ParseIP(host) != nil {
+		return host
+	}
+	labels := strings.Split(host, ".")
+	keep := 2
+	if n := len(labels); n >= 3 && len(labels[n-1]) == 2 && len(labels[n-2]) <= 3 {
+		keep = 3
+	}
+	if len(labels) <= keep {
+		return host
+	}
+	return strings.Join(labels[len(labels)-keep:], ".")
+}
+
+// defaultSensitivePatterns are path fragments that commonly show up in
+// probes for secrets and admin interfaces.
+var defaultSensitivePatterns = []string{
+	"/.env",
+	"/.git/",
+	"/.aws/",
+	"/.ssh/",
+	"/wp-admin",
+	"/wp-login.php",
+	"/xmlrpc.php",
+	"/admin",
+	"/phpmyadmin",
+	"/server-status",
+	"/config.php",
+}
+
+// isSensitivePath reports whether a path, ignoring case and the query
+// string, contains one of la.sensitivePatterns.
+func (la *LogAnalyzer) isSensitivePath(path string) bool {
+	path = strings.ToLower(stripQuery(path))
+	for _, p := range la.sensitivePatterns {
+		if strings.Contains(path, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// loadPatterns reads one pattern per line from a file, skipping blank
+// lines and # comments.
+func loadPatterns(name string) ([]string, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, fmt.Errorf("error reading patterns: %w", err)
+	}
+	var patterns []string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		patterns = append(patterns, strings.ToLower(line))
+	}
+	return patterns, nil
+}
+
+// agentPattern maps a user agent substring to a classification.
+type agentPattern struct {
+	substr string
+	class  string
+}
+
+// osPatterns are the user agent substrings used by classifyOS, matched
+// case-insensitively and in order, so more specific patterns come first:
+// Android agents also mention Linux, and iOS agents mention Mac OS X.
+// Append to it to recognize more platforms.
+var osPatterns = []agentPattern{
+	{"android", "Android"},
+	{"iphone", "iOS"},
+	{"ipad", "iOS"},
+	{"ipod", "iOS"},
+	{"windows", "Windows"},
+	{"macintosh", "macOS"},
+	{"mac os x", "macOS"},
+	{"linux", "Linux"},
+}
+
+// classifyOS returns the operating system named in a user agent, or
+// "Other" when none of osPatterns match.
+func classifyOS(ua string) string {
+	return classifyAgentBy(ua, osPatterns)
+}
+
+// browserPatterns are the user agent substrings used by classifyBrowser,
+// matched case-insensitively and in order. The rules are deliberately
+// simple:
+//   - bots and crawlers are recognized first, since many claim to be a
+//     browser too;
+//   - Edge agents also contain "Chrome/" and "Safari/", and Chrome agents
+//     contain "Safari/", so Edge is checked before Chrome and Chrome
+//     before Safari;
+//   - CriOS and FxiOS are Chrome and Firefox on iOS.
+//
+// Anything else, including command-line clients, is "Other".
+var browserPatterns = []agentPattern{
+	{"bot", "Bot"},
+	{"crawler", "Bot"},
+	{"spider", "Bot"},
+	{"slurp", "Bot"},
+	{"edg/", "Edge"},
+	{"edge/", "Edge"},
+	{"chrome/", "Chrome"},
+	{"crios/", "Chrome"},
+	{"firefox/", "Firefox"},
+	{"fxios/", "Firefox"},
+	{"safari/", "Safari"},
+}
+
+// classifyBrowser returns the browser family of a user agent: Chrome,
+// Firefox, Safari, Edge, Bot or Other (see browserPatterns).
+func classifyBrowser(ua string) string {
+	return classifyAgentBy(ua, browserPatterns)
+}
+
+// isBrowser reports whether classifyBrowser puts ua in a browser family,
+// rather than Bot or Other.
+func isBrowser(ua string) bool {
+	switch classifyBrowser(ua) {
+	case "Bot", "Other":
+		return false
+	}
+	return true
+}
+
+// versionTokens are the user agent tokens, lowercase, that precede the
+// version of each browser family, in order of preference. Safari writes
+// its version after "Version/"; its "Safari/" token is the WebKit build.
+var versionTokens = map[string][]string{
+	"Chrome":  {"chrome/", "crios/"},
+	"Firefox": {"firefox/", "fxios/"},
+	"Edge":    {"edg/", "edge/"},
+	"Safari":  {"version/"},
+}
+
+// agentVersion returns the browser family and major version of a user
+// agent, e.g. "Chrome 119", or "Chrome (unknown version)" when the version
+// cannot be found. It returns "" when ua is not a browser of family, or of
+// any family when family is "all".
+func agentVersion(ua, family string) string {
+	class := classifyBrowser(ua)
+	tokens, ok := versionTokens[class]
+	if !ok || (family != "all" && class != family) {
+		return ""
+	}
+	lower := strings.ToLower(ua)
+	for _, token := range tokens {
+		i := strings.Index(lower, token)
+		if i < 0 {
+			continue
+		}
+		v := ua[i+len(token):]
+		end := 0
+		for end < len(v) && isDigit(v[end]) {
+			end++
+		}
+		if end > 0 {
+			return class + " " + v[:end]
+		}
+	}
+	return class + " (unknown version)"
+}
+
+// agentVersions totals user agent counts by agentVersion for family,
+// leaving out the other agents.
+func agentVersions(agentCounts map[string]int, family string) map[string]int {
+	versions := make(map[string]int)
+	for ua, count := range agentCounts {
+		if v := agentVersion(ua, family); v != "" {
+			versions[v] += count
+		}
+	}
+	return versions
+}
+
+// agentVersionNumber matches the version numbers in a user agent: after a
+// product token's "/", as in "Chrome/119.0.0.0", or after a space or ":",
+// as in "Windows NT 10.0", "Mac OS X 10_15_7" and "rv:109.0".
+var agentVersionNumber = regexp.MustCompile(`/v?\d[\w.+-]*|[ :]v?\d[\d._]*\b`)
+
+// stripAgentVersions removes the version numbers from a user agent, so
+// that e.g. every Chrome release on Windows counts as
+// "Mozilla (Windows NT; Win64; x64) AppleWebKit (KHTML, like Gecko) Chrome Safari".
+func stripAgentVersions(ua string) string {
+	return agentVersionNumber.ReplaceAllString(ua, "")
+}
+
+// nonBrowserAgents returns the counts of the user agents that are not
+// browsers, such as scripts, HTTP libraries and bots.
+func nonBrowserAgents(agentCounts map[string]int) map[string]int {
+	agents := make(map[string]int)
+	for ua, count := range agentCounts {
+		if !isBrowser(ua) {
+			agents[ua] = count
+		}
+	}
+	return agents
+}
+
+// classifyAgentBy returns the class of the first pattern found in ua, or
+// "Other".
+func classifyAgentBy(ua string, patterns []agentPattern) string {
+	ua = strings.ToLower(ua)
+	for _, p := range patterns {
+		if strings.Contains(ua, strings.ToLower(p.substr)) {
+			return p.class
+		}
+	}
+	return "Other"
+}
+
+// groupAgents totals user agent counts by the class classify assigns.
+func groupAgents(agentCounts map[string]int, classify func(string) string) map[string]int {
+	groups := make(map[string]int)
+	for ua, count := range agentCounts {
+		groups[classify(ua)] += count
+	}
+	return groups
+}
+
+// stripQuery removes the query string, if any, from a request path.
+func stripQuery(path string) string {
+	if i := strings.IndexByte(path, '?'); i >= 0 {
+		return path[:i]
+	}
+	return path
+}
+
+// cleanPath canonicalizes the path part of a request path with path.Clean,
+// collapsing repeated slashes and resolving "." and ".." segments, while
+// keeping the query string and a trailing slash. Paths that do not start
+// with "/", such as "*" or absolute URLs, are returned unchanged.
+func cleanPath(p string) string {
+	query := ""
+	if i := strings.IndexByte(p, '?'); i >= 0 {
+		p, query = p[:i], p[i:]
+	}
+	if !strings.HasPrefix(p, "/") {
+		return p + query
+	}
+	cleaned := path.Clean(p)
+	if strings.HasSuffix(p, "/") && cleaned != "/" {
+		cleaned += "/"
+	}
+	return cleaned + query
+}
+
+// trimTrailingSlash strips the trailing slashes of a path, before any
+// query string, so "/about/" and "/about/?a=1" count as "/about" and
+// "/about?a=1". The root "/" is kept.
+func trimTrailingSlash(p string) string {
+	query := ""
+	if i := strings.IndexByte(p, '?'); i >= 0 {
+		p, query = p[:i], p[i:]
+	}
+	if trimmed := strings.TrimRight(p, "/"); trimmed != "" {
+		p = trimmed
+	} else if p != "" {
+		p = "/"
+	}
+	return p + query
+}
+
+// isTraversal reports whether a raw request path, once percent-decoded,
+// has a ".." segment anywhere, including the query string, as path
+// traversal probes do. Both "/" and "\" count as separators.
+func isTraversal(p string) bool {
+	if !strings.Contains(p, "..") && !strings.Contains(strings.ToLower(p), "%2e") {
+		return false
+	}
+	if decoded, err := url.PathUnescape(p); err == nil {
+		p = decoded
+	}
+	for _, segment := range strings.FieldsFunc(p, func(r rune) bool {
+		return strings.ContainsRune("/\\?&=", r)
+	}) {
+		if segment == ".." {
+			return true
+		}
+	}
+	return false
+}
+
+// pathDepth counts the non-empty segments of a path, ignoring the query
+// string: "/" has depth 0, "/about" depth 1 and "/a/b/c/d" depth 4.
+func pathDepth(path string) int {
+	depth := 0
+	for _, segment := range strings.Split(stripQuery(path), "/") {
+		if segment != "" {
+			depth++
+		}
+	}
+	return depth
+}
+
+// depthHistogram totals path counts by path depth and returns them in
+// ascending depth order.
+func depthHistogram(pathCounts map[string]int) []ResultItem {
+	byDepth := make(map[int]int)
+	for path, count := range pathCounts {
+		byDepth[pathDepth(path)] += count
+	}
+
+	depths := make([]int, 0, len(byDepth))
+	for depth := range byDepth {
+		depths = append(depths, depth)
+	}
+	sort.Ints(depths)
+
+	results := make([]ResultItem, 0, len(depths))
+	for _, depth := range depths {
+		results = append(results, ResultItem{Value: fmt.Sprintf("depth %d", depth), Count: byDepth[depth]})
+	}
+	return results
+}
+
+// sizeBuckets are the response size buckets in ascending order, each with
+// its exclusive upper bound in bytes.
+var sizeBuckets = []struct {
+	label string
+	limit int64
+}{
+	{"<1KB", 1 << 10},
+	{"1-10KB", 10 << 10},
+	{"10-100KB", 100 << 10},
+	{"100KB-1MB", 1 << 20},
+	{">1MB", math.MaxInt64},
+}
+
+// sizeBucket returns the label of the bucket a response size falls into.
+func sizeBucket(bytes int64) string {
+	for _, b := range sizeBuckets {
+		if bytes < b.limit {
+			return b.label
+		}
+	}
+	return sizeBuckets[len(sizeBuckets)-1].label
+}
+
+// sizeHistogram returns the size bucket counts in bucket order.
+func sizeHistogram(bucketCounts map[string]int) []ResultItem {
+	results := make([]ResultItem, 0, len(sizeBuckets))
+	for _, b := range sizeBuckets {
+		results = append(results, ResultItem{Value: b.label, Count: bucketCounts[b.label]})
+	}
+	if n := bucketCounts[noneKey]; n > 0 {
+		results = append(results, ResultItem{Value: noneKey, Count: n})
+	}
+	return results
+}
+
+// latency summarizes a set of request durations, in microseconds.
+type latency struct {
+	count              int
+	avg, p50, p95, p99 int64
+}
+
+// latencyOf computes the average and percentiles of durations. It sorts
+// a copy, since reports only hold the read lock and may run together.
+func latencyOf(durations []int64) latency {
+	durations = slices.Clone(durations)
+	slices.Sort(durations)
+	var sum int64
+	for _, d := range durations {
+		sum += d
+	}
+	return latency{
+		count: len(durations),
+		avg:   sum / int64(len(durations)),
+		p50:   percentile(durations, 50),
+		p95:   percentile(durations, 95),
+		p99:   percentile(durations, 99),
+	}
+}
+
+// percentile returns the nearest-rank p-th percentile of sorted values.
+func percentile(sorted []int64, p int) int64 {
+	rank := (p*len(sorted) + 99) / 100
+	return sorted[max(rank, 1)-1]
+}
+
+// formatMicros renders a duration in microseconds, e.g. "1.25ms".
+func formatMicros(us int64) string {
+	return (time.Duration(us) * time.Microsecond).String()
+}
+
+// String renders the summary for the latency report.
+func (l latency) String() string {
+	return fmt.Sprintf("avg %s, p50 %s, p95 %s, p99 %s (%s requests)",
+		formatMicros(l.avg), formatMicros(l.p50), formatMicros(l.p95), formatMicros(l.p99), formatInt(l.count))
+}
+
+// printLatency prints the overall request latency followed by that of the
+// n paths with the most timed requests (all paths when n is 0).
+func (la *LogAnalyzer) printLatency(n int) {
+	fmt.Printf("\nRequest latency (%s paths by timed requests):\n", topLabel(n))
+	if len(la.pathDurations) == 0 {
+		fmt.Println("(no request durations logged; use -regex with a duration group)")
+		return
+	}
+	var all []int64
+	timed := make(map[string]int, len(la.pathDurations))
+	for path, durations := range la.pathDurations {
+		all = append(all, durations...)
+		timed[path] = len(durations)
+	}
+	fmt.Printf("%s - %s\n", colorize("(all paths)", ansiBold), latencyOf(all))
+	for _, item := range getTopN(timed, n) {
+		fmt.Printf("%s - %s\n", colorize(item.Value, ansiBold), latencyOf(la.pathDurations[item.Value]))
+	}
+}
+
+// formatBytes renders a byte count with a binary unit, e.g. "1.5 MiB".
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return formatInt(int(n)) + " B"
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%s %ciB", formatFloat(float64(n)/float64(div)), "KMGTPE"[exp])
+}
+
+// printBytesResults prints results whose counts are byte totals.
+func printBytesResults(title string, results []ResultItem) {
+	fmt.Printf("\n%s:\n", title)
+	for _, item := range results {
+		value := colorize(item.Value, ansiBold)
+		count := colorize(formatBytes(int64(item.Count)), ansiDim)
+		fmt.Printf("%s - %s\n", value, count)
+	}
+}
+
+// printStatusBytes prints the bytes served per status code, largest first,
+// with the average response size of each code.
+func (la *LogAnalyzer) printStatusBytes(title string) {
+	fmt.Printf("\n%s:\n", title)
+	for _, item := range getTopN(la.bytesPerStatus, 0) {
+		value := colorize(item.Value, statusColor(item.Value))
+		total := colorize(formatBytes(int64(item.Count)), ansiDim)
+		fmt.Printf("%s - %s", value, total)
+		if requests := la.statusCounts[item.Value]; requests > 0 {
+			fmt.Printf(" (avg %s)", formatBytes(int64(item.Count)/int64(requests)))
+		}
+		fmt.Println()
+	}
+}
+
+// sparkBlocks are the levels of a sparkline, lowest first.
+var sparkBlocks = []rune("▁▂▃▄▅▆▇█")
+
+// maxSparkWidth caps the number of characters in a sparkline.
+const maxSparkWidth = 60
+
+// sparkline renders counts as Unicode block characters scaled to the
+// largest count. Longer series are summed down to maxSparkWidth points.
+func sparkline(counts []int) string {
+	if len(counts) > maxSparkWidth {
+		step := (len(counts) + maxSparkWidth - 1) / maxSparkWidth
+		merged := make([]int, 0, maxSparkWidth)
+		for i := 0; i < len(counts); i += step {
+			sum := 0
+			for _, c := range counts[i:min(i+step, len(counts))] {
+				sum += c
+			}
+			merged = append(merged, sum)
+		}
+		counts = merged
+	}
+
+	peak := 0
+	for _, c := range counts {
+		peak = max(peak, c)
+	}
+	var b strings.Builder
+	for _, c := range counts {
+		level := 0
+		if peak > 0 {
+			level = c * (len(sparkBlocks) - 1) / peak
+		}
+		b.WriteRune(sparkBlocks[level])
+	}
+	return b.String()
+}
+
+// smooth returns the moving average of series over the last window
+// points, so single-bucket spikes do not dominate a sparkline. A window of
+// 1 or less returns series unchanged.
+func smooth(series []int, window int) []int {
+	if window <= 1 {
+		return series
+	}
+	smoothed := make([]int, len(series))
+	for i, avg := range movingAverage(series, window) {
+		smoothed[i] = int(avg)
+	}
+	return smoothed
+}
+
+// movingAverage returns the simple moving average of series over the last
+// window points, or fewer at the start of the series.
+func movingAverage(series []int, window int) []float64 {
+	averages := make([]float64, len(series))
+	sum := 0
+	for i, c := range series {
+		sum += c
+		if i >= window {
+			sum -= series[i-window]
+		}
+		averages[i] = float64(sum) / float64(min(i+1, window))
+	}
+	return averages
+}
+
+// printRequestsPerMinute prints the requests of every minute from the first
+// to the last timestamp, with their moving average over window minutes.
+// Empty minutes whose average is 0 are summarized in one line per run, so
+// a stray far-off timestamp does not print millions of rows.
+func (la *LogAnalyzer) printRequestsPerMinute(window int) {
+	fmt.Printf("\nRequests per minute, with a %d-minute moving average:\n", window)
+	if la.firstTime.IsZero() {
+		fmt.Println("(no timestamped requests)")
+		return
+	}
+	minutes := make([]int64, 0, len(la.minuteCounts))
+	for minute := range la.minuteCounts {
+		minutes = append(minutes, minute)
+	}
+	sort.Slice(minutes, func(i, j int) bool { return minutes[i] < minutes[j] })
+
+	// sum totals minutes[start:end], the minutes with requests in the
+	// window ending at the minute printed.
+	first, sum, start, end := minutes[0], 0, 0, 0
+	row := func(minute int64) {
+		for end < len(minutes) && minutes[end] <= minute {
+			sum += la.minuteCounts[minutes[end]]
+			end++
+		}
+		for start < end && minutes[start] <= minute-int64(window) {
+			sum -= la.minuteCounts[minutes[start]]
+			start++
+		}
+		avg := float64(sum) / float64(min(minute-first+1, int64(window)))
+		t := time.Unix(minute*60, 0).In(la.firstTime.Location())
+		fmt.Printf("%s %8s %s\n", colorize(t.Format("2006-01-02 15:04"), ansiBold), formatInt(la.minuteCounts[minute]), colorize("avg "+formatFloat(avg), ansiDim))
+	}
+	for i, minute := range minutes {
+		if i > 0 {
+			// The minutes right after one with requests still average
+			// them in; the rest of the gap is all zeros.
+			prev := minutes[i-1]
+			averaged := min(prev+int64(window)-1, minute-1)
+			for m := prev + 1; m <= averaged; m++ {
+				row(m)
+			}
+			if quiet := minute - 1 - averaged; quiet > 0 {
+				fmt.Println(colorize(fmt.Sprintf("(%s minutes without requests)", formatInt(int(quiet))), ansiDim))
+			}
+		}
+		row(minute)
+	}
+}
+
+// printTrafficSparkline prints a one-line sparkline of the requests per
+// time bucket over the log's time range, smoothed over window buckets.
+func (la *LogAnalyzer) printTrafficSparkline(window int) {
+	series := bucketSeries(la, la.requestBuckets)
+	if len(series) == 0 {
+		fmt.Println("\nTraffic: no timestamps")
+		return
+	}
+	peak := 0
+	for _, c := range series {
+		peak = max(peak, c)
+	}
+	detail := fmt.Sprintf("peak %s per %s", formatInt(peak), la.seriesStep())
+	if window > 1 {
+		detail += fmt.Sprintf(", smoothed over %s buckets", formatInt(window))
+	}
+	fmt.Printf("\nTraffic %s to %s: %s %s\n", formatTimestamp(la.firstTime), formatTimestamp(la.lastTime),
+		sparkline(smooth(series, window)), colorize(detail, ansiDim))
+}
+
+// ipSeenNote returns the first and last request time of an IP, for the
+// IP report, or "(unknown)" for IPs without a valid timestamp.
+func (la *LogAnalyzer) ipSeenNote(ip string) string {
+	seen, ok := la.ipSeen[ip]
+	if !ok {
+		return "first and last seen " + formatTimestamp(time.Time{})
+	}
+	return fmt.Sprintf("first seen %s, last seen %s", formatTimestamp(seen[0]), formatTimestamp(seen[1]))
+}
+
+// printIPTimelines prints a sparkline of the activity of each of the top
+// n IPs over the log's time range.
+func (la *LogAnalyzer) printIPTimelines(n int) {
+	fmt.Printf("\nActivity of the %s IP addresses (%s buckets, %s to %s):\n",
+		strings.ToLower(topLabel(n)), la.seriesStep(), formatTimestamp(la.firstTime), formatTimestamp(la.lastTime))
+	for _, item := range getTopN(la.ipCounts, n) {
+		series := bucketSeries(la, la.ipBuckets[item.Value])
+		peak := 0
+		for _, c := range series {
+			peak = max(peak, c)
+		}
+		value := colorize(item.Value, ansiBold)
+		detail := colorize(fmt.Sprintf("%s requests, peak %s per bucket", formatInt(item.Count), formatInt(peak)), ansiDim)
+		fmt.Printf("%s %s %s\n", value, sparkline(series), detail)
+	}
+}
+
+// pathChange is the request count of a path before and from the median
+// timestamp on.
+type pathChange struct {
+	path          string
+	before, after int
+}
+
+// delta returns the change in requests between the two halves.
+func (c pathChange) delta() int {
+	return c.after - c.before
+}
+
+// pathChanges splits the timed requests at their median timestamp and
+// returns the per-path counts of both halves, biggest absolute change
+// first, along with the median.
+func (la *LogAnalyzer) pathChanges() ([]pathChange, time.Time) {
+	var all []int64
+	for _, times := range la.pathTimes {
+		all = append(all, times...)
+	}
+	if len(all) == 0 {
+		return nil, time.Time{}
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i] < all[j] })
+	median := all[len(all)/2]
+
+	changes := make([]pathChange, 0, len(la.pathTimes))
+	for path, times := range la.pathTimes {
+		c := pathChange{path: path}
+		for _, t := range times {
+			if t < median {
+				c.before++
+			} else {
+				c.after++
+			}
+		}
+		changes = append(changes, c)
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		di, dj := abs(changes[i].delta()), abs(changes[j].delta())
+		if di != dj {
+			return di > dj
+		}
+		return changes[i].path < changes[j].path
+	})
+	return changes, time.Unix(0, median).In(la.firstTime.Location())
+}
+
+// abs returns the absolute value of n.
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// printTopChanges prints the n paths whose request count changed the most
+// between the first and second half of the log's time range.
+func (la *LogAnalyzer) printTopChanges(n int) {
+	changes, median := la.pathChanges()
+	fmt.Printf("\n%s path changes between halves (split at %s):\n", topLabel(n), formatTimestamp(median))
+	if len(changes) == 0 {
+		fmt.Println("(no timestamped requests)")
+		return
+	}
+	if n > 0 && len(changes) > n {
+		changes = changes[:n]
+	}
+	for _, c := range changes {
+		sign := "+"
+		if c.delta() < 0 {
+			sign = "-"
+		}
+		value := colorize(c.path, ansiBold)
+		detail := colorize(fmt.Sprintf("%s -> %s requests (%s%s)", formatInt(c.before), formatInt(c.after), sign, formatInt(abs(c.delta()))), ansiDim)
+		fmt.Printf("%s - %s\n", value, detail)
+	}
+}
+
+// hourClasses are the status class columns of the hour of day and method
+// tables.
+var hourClasses = []string{"2xx", "3xx", "4xx", "5xx"}
+
+// printMethodStatus prints a table of requests per method and status
+// class, busiest method first, with an "other" column for the codes
+// outside hourClasses when there are any.
+func (la *LogAnalyzer) printMethodStatus() {
+	fmt.Println("\nRequests per method and status class:")
+	if len(la.methodClassCounts) == 0 {
+		fmt.Println("(no request methods logged)")
+		return
+	}
+	showOther := false
+	for _, counts := range la.methodClassCounts {
+		for class := range counts {
+			if !slices.Contains(hourClasses, class) {
+				showOther = true
+			}
+		}
+	}
+
+	header := fmt.Sprintf("%-8s", "method")
+	for _, class := range hourClasses {
+		header += fmt.Sprintf(" %10s", class)
+	}
+	if showOther {
+		header += fmt.Sprintf(" %10s", "other")
+	}
+	header += fmt.Sprintf(" %10s", "total")
+	fmt.Println(colorize(header, ansiBold))
+	for _, item := range getTopN(la.methodCounts, 0) {
+		counts := la.methodClassCounts[item.Value]
+		row := fmt.Sprintf("%-8s", item.Value)
+		other := 0
+		for class, n := range counts {
+			if !slices.Contains(hourClasses, class) {
+				other += n
+			}
+		}
+		for _, class := range hourClasses {
+			row += " " + colorize(fmt.Sprintf("%10s", formatInt(counts[class])), statusColor(class))
+		}
+		if showOther {
+			row += fmt.Sprintf(" %10s", formatInt(other))
+		}
+		row += fmt.Sprintf(" %10s", formatInt(item.Count))
+		fmt.Println(row)
+	}
+}
+
+// printHourStatus prints a table of requests per hour of day (rows) and
+// status class (columns). Other classes, such as 1xx and nonstandard
+// codes, share an "other" column that is only shown when needed.
+func (la *LogAnalyzer) printHourStatus() {
+	fmt.Println("\nRequests per hour of day and status class:")
+	if la.firstTime.IsZero() {
+		fmt.Println("(no timestamped requests)")
+		return
+	}
+	showOther := false
+	for _, counts := range la.hourClassCounts {
+		for class := range counts {
+			if !slices.Contains(hourClasses, class) {
+				showOther = true
+			}
+		}
+	}
+
+	header := fmt.Sprintf("%-5s", "hour")
+	for _, class := range hourClasses {
+		header += fmt.Sprintf(" %10s", class)
+	}
+	if showOther {
+		header += fmt.Sprintf(" %10s", "other")
+	}
+	fmt.Println(colorize(header, ansiBold))
+	for hour, counts := range la.hourClassCounts {
+		row := fmt.Sprintf("%02d:00", hour)
+		other := 0
+		for class, n := range counts {
+			if !slices.Contains(hourClasses, class) {
+				other += n
+			}
+		}
+		for _, class := range hourClasses {
+			row += " " + colorize(fmt.Sprintf("%10s", formatInt(counts[class])), statusColor(class))
+		}
+		if showOther {
+			row += fmt.Sprintf(" %10s", formatInt(other))
+		}
+		fmt.Println(row)
+	}
+}
+
+// printResults prints the top N results for a given title and slice.
+func printResults(title string, results []ResultItem) {
+	printColoredResults(title, results, nil)
+}
+
+// printStatusResults prints status code results, colored by status class.
+// The nonstandardStatus codes are labeled with their meaning.
+func printStatusResults(title string, results []ResultItem) {
+	fprintStatusResults(os.Stdout, title, results)
+}
+
+// fprintStatusResults is printStatusResults writing to w.
+func fprintStatusResults(w io.Writer, title string, results []ResultItem) {
+	labeled := make([]ResultItem, len(results))
+	for i, item := range results {
+		labeled[i] = item
+		if meaning, ok := nonstandardStatus[item.Value]; ok {
+			labeled[i].Value += " (" + nonstandardClass + ": " + meaning + ")"
+		}
+	}
+	fprintColoredResults(w, title, labeled, statusColor, nil)
+}
+
+// printColoredResults prints results with bold values and dimmed counts.
+// valueColor, if non-nil, picks an extra color for each value.
+func printColoredResults(title string, results []ResultItem, valueColor func(string) string) {
+	fprintColoredResults(os.Stdout, title, results, valueColor, nil)
+}
+
+// fprintColoredResults is printColoredResults writing to w. note, if set,
+// returns a dimmed note to print after the count of a value.
+func fprintColoredResults(w io.Writer, title string, results []ResultItem, valueColor, note func(string) string) {
+	fmt.Fprintf(w, "\n%s:\n", title)
+	for _, item := range results {
+		codes := []string{ansiBold}
+		if valueColor != nil {
+			if c := valueColor(item.Value); c != "" {
+				codes = append(codes, c)
+			}
+		}
+		value := colorize(item.Value, codes...)
+		count := formatInt(item.Count) + " requests"
+		if item.Bytes > 0 {
+			count += ", " + formatBytes(item.Bytes)
+		}
+		if note != nil {
+			count += " (" + note(item.Value) + ")"
+		}
+		fmt.Fprintf(w, "%s - %s\n", value, colorize(count, ansiDim))
+	}
+}
+
+// explorerHelp lists the commands understood by runExplorer.
+const explorerHelp = `Commands:
+  ips | paths | status | agents   show that report
+  top <n>                         number of rows to show
+  sort count|value                order rows by count or by value
+  filter <text>                   only show values containing text ("filter" clears)
+  drill <status>                  show the paths that returned a status code
+  help                            show this help
+  quit                            exit`
+
+// runExplorer is a small line-driven interactive view of the results: a
+// command prompt read from in, not a full-screen interface. It keeps the
+// current report, row limit, sort order and filter between commands so
+// that the results can be narrowed down step by step.
+func runExplorer(in io.Reader, out io.Writer, la *LogAnalyzer) {
+	reports := map[string]map[string]int{
+		"ips":    la.ipCounts,
+		"paths":  la.pathCounts,
+		"status": la.statusCounts,
+		"agents": la.agentCounts,
+	}
+	current, title := "status", "status"
+	counts := la.statusCounts
+	limit, sortBy, filter := 10, "count", ""
+
+	show := func() {
+		var results []ResultItem
+		for _, item := range getTopN(counts, 0) {
+			if filter == "" || strings.Contains(strings.ToLower(item.Value), strings.ToLower(filter)) {
+				results = append(results, item)
+			}
+		}
+		if sortBy == "value" {
+			sort.Slice(results, func(i, j int) bool { return results[i].Value < results[j].Value })
+		}
+		if len(results) > limit {
+			results = results[:limit]
+		}
+
+		header := title
+		if filter != "" {
+			header += fmt.Sprintf(" (filter %q)", filter)
+		}
+		fmt.Fprintf(out, "\n%s, %s rows by %s:\n", header, formatInt(len(results)), sortBy)
+		for _, item := range results {
+			fmt.Fprintf(out, "  %s - %s requests\n", item.Value, formatInt(item.Count))
+		}
+	}
+
+	fmt.Fprintln(out, explorerHelp)
+	show()
+	scanner := bufio.NewScanner(in)
+	for {
+		fmt.Fprintf(out, "\n[%s]> ", current)
+		if !scanner.Scan() {
+			fmt.Fprintln(out)
+			return
+		}
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+
+		switch cmd, args := fields[0], fields[1:]; cmd {
+		case "ips", "paths", "status", "agents":
+			current, title, counts, filter = cmd, cmd, reports[cmd], ""
+			show()
+		case "top":
+			n, err := strconv.Atoi(strings.Join(args, ""))
+			if err != nil || n <= 0 {
+				fmt.Fprintln(out, "usage: top <n>")
+				continue
+			}
+			limit = n
+			show()
+		case "sort":
+			if len(args) != 1 || (args[0] != "count" && args[0] != "value") {
+				fmt.Fprintln(out, "usage: sort count|value")
+				continue
+			}
+			sortBy = args[0]
+			show()
+		case "filter":
+			filter = strings.Join(args, " ")
+			show()
+		case "drill":
+			if len(args) != 1 || la.statusPathCounts[args[0]] == nil {
+				fmt.Fprintln(out, "usage: drill <status> (a status code present in the log)")
+				continue
+			}
+			current, title, counts, filter = "status "+args[0], "paths with status "+args[0], la.statusPathCounts[args[0]], ""
+			show()
+		case "help":
+			fmt.Fprintln(out, explorerHelp)
+		case "quit", "exit":
+			return
+		default:
+			fmt.Fprintf(out, "unknown command %q, type help for a list\n", cmd)
+		}
+	}
+}
+
+// stringList is a flag.Value collecting every occurrence of a repeatable
+// flag.
+type stringList []string
+
+func (s *stringList) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringList) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+// options holds the command-line settings.
+type options struct {
+	urls              stringList
+	healthPaths       stringList
+	excludePaths      stringList
+	monitorIPs        stringList
+	ipWhitelist       stringList
+	compact           bool
+	summaryOnly       bool
+	showRPS           bool
+	numberFormat      string
+	only              stringList
+	dryRun            bool
+	head              int
+	tail              int
+	format            string
+	templateFile      string
+	template          *template.Template
+	influxPaths       bool
+	influxIPs         bool
+	output            string
+	emitEntries       string
+	emitLineNumbers   bool
+	topN              int
+	minRequests       int
+	colorMode         string
+	customRegex       string
+	groupPrefixDepth  int
+	showDepth         bool
+	showOS            bool
+	showBrowsers      bool
+	agentVersions     string
+	showNonBrowsers   bool
+	showHosts         bool
+	filterVHost       string
+	includeStatus     string
+	excludeStatus     string
+	statusRegex       string
+	showReferers      bool
+	showDirectPaths   bool
+	showUsers         bool
+	referersByDomain  bool
+	showProtocols     bool
+	showMethods       bool
+	methodStatus      bool
+	showFingerprints  bool
+	dropEmpty         bool
+	showSensitive     bool
+	showMalformed     bool
+	sensitiveFile     string
+	showTopErrors     bool
+	showAgentBytes    bool
+	sortBy            string
+	showStatusBytes   bool
+	showImportance    bool
+	importanceWeight  float64
+	showSizes         bool
+	showLatency       bool
+	ipTimeline        bool
+	firstLastSeen     bool
+	sparkline         bool
+	smooth            int
+	rpmWindow         int
+	topChanges        bool
+	uniquePathsPerIP  bool
+	scannerMinPaths   int
+	agentsPerIP       bool
+	maxAgentsPerIP    int
+	authFailures      bool
+	authFailuresMin   int
+	hourStatus        bool
+	bandwidthTimeline bool
+	bucketSize        time.Duration
+	tui               bool
+	anonymizeIPs      bool
+	maxCardinality    int
+	approxTop         int
+	ignoreCase        bool
+	ignoreCasePaths   bool
+	joinContinuations bool
+	syslog            bool
+	normalizeStatus   bool
+	cleanPaths        bool
+	trimTrailingSlash bool
+	ignoreCaseAgents  bool
+	dedupeAgents      bool
+	explain           bool
+	explainLines      int
+	verbose           bool
+	maxSkipSamples    int
+	failOn5xxPct      float64
+	compare           string
+	compareThreshold  float64
+	failOnChange      bool
+	failOnErrorRise   float64
+	webhook           string
+	outputDir         string
+	chart             string
+	outputFormat      string
+	config            string
+}
+
+// parseOptions defines the command-line flags, parses them and validates
+// their values.
+func parseOptions() (options, error) {
+	var opts options
+	flag.Var(&opts.urls, "url", "log file URL to analyze (repeatable; results are combined); overrides $LOG_URL")
+	flag.Var(&opts.excludePaths, "exclude-path", "path whose requests are left out of the analysis, compared without query string (repeatable)")
+	flag.Var(&opts.healthPaths, "health-path", "path of health check requests, left out of the real traffic summary (repeatable)")
+	flag.Var(&opts.monitorIPs, "monitor-ip", "IP or CIDR range of a monitor, left out of the real traffic summary (repeatable)")
+	flag.Var(&opts.ipWhitelist, "ip-whitelist", "comma separated IPs or CIDR ranges, or a file of them, left out of the security reports only (repeatable)")
+	flag.StringVar(&opts.format, "format", "text", "report format: text, json, json-full (with source and line count metadata), csv, ndjson, xml, influx (line protocol), prometheus-textfile or template")
+	flag.BoolVar(&opts.influxPaths, "influx-paths", false, "with -format influx, also write the top paths as log_path points (one series per path)")
+	flag.BoolVar(&opts.influxIPs, "influx-ips", false, "with -format influx, also write the top IPs as log_ip points (one series per IP)")
+	flag.StringVar(&opts.templateFile, "template", "", "render the results through this Go text/template file (implies -format template)")
+	flag.StringVar(&opts.output, "output", "", "write a non-text report to this file (replaced atomically) instead of stdout")
+	flag.StringVar(&opts.emitEntries, "emit-entries", "", "write every parsed entry as a JSON line to this file (\"-\" for stdout, replacing the reports)")
+	flag.BoolVar(&opts.emitLineNumbers, "emit-line-numbers", false, "add each entry's line number in its source to -emit-entries")
+	flag.BoolVar(&opts.compact, "compact", false, "print only a one-line summary of key metrics")
+	flag.BoolVar(&opts.showRPS, "rps", false, "also print the average requests per second over the log's time span")
+	flag.BoolVar(&opts.summaryOnly, "summary-only", false, "print only the summary block (totals, unique counts, 5xx share) in the -format, without the top-N lists")
+	flag.Var(&opts.only, "only", "report only this category: ips, paths, status or agents (repeatable; default all)")
+	flag.IntVar(&opts.head, "head", 0, "only analyze the first N lines of each log (0 for all)")
+	flag.IntVar(&opts.tail, "tail", 0, "only analyze the last N lines of each log (0 for all)")
+	flag.BoolVar(&opts.dryRun, "dry-run", false, "check each input's first lines against the formats and exit without analyzing")
+	flag.IntVar(&opts.topN, "top", 5, "number of items per report (0 for all)")
+	flag.IntVar(&opts.minRequests, "min-requests", 0, "leave IPs with fewer requests than this out of the IP report, e.g. one-off visitors")
+	flag.StringVar(&opts.colorMode, "color", "auto", "colorize text output: auto, always or never")
+	flag.StringVar(&opts.customRegex, "regex", "", "custom line regex with named groups ip, path, status and optionally vhost, protocol, bytes, referer, agent, time, duration")
+	flag.IntVar(&opts.groupPrefixDepth, "group-prefix-depth", 0, "also report paths grouped by their first N segments (0 disables)")
+	flag.BoolVar(&opts.showDepth, "path-depth", false, "also report requests by URL path depth")
+	flag.BoolVar(&opts.showOS, "os", false, "also report traffic by user agent operating system")
+	flag.BoolVar(&opts.showBrowsers, "browsers", false, "also report traffic by browser family")
+	flag.StringVar(&opts.agentVersions, "group-by-agent-version", "", "also report the traffic of a browser family (Chrome, Firefox, Safari, Edge or all) by major version")
+	flag.BoolVar(&opts.showNonBrowsers, "top-agents-excluding-browsers", false, "also report the top user agents that are not browsers (scripts, libraries, bots)")
+	flag.BoolVar(&opts.showHosts, "hosts", false, "also report top hosts by requests, from the vhost group or absolute request URLs (proxy logs)")
+	flag.StringVar(&opts.filterVHost, "filter-vhost", "", "only analyze requests for this host (vhost group or absolute request URL)")
+	flag.StringVar(&opts.includeStatus, "include-status", "", "only analyze requests with these status codes, e.g. 200,301-308,5xx")
+	flag.StringVar(&opts.statusRegex, "status-regex", "", "only analyze requests whose status code matches this regex, e.g. ^(429|5..)$")
+	flag.StringVar(&opts.excludeStatus, "exclude-status", "", "leave out requests with these status codes, e.g. 200,304 (applied after -include-status)")
+	flag.BoolVar(&opts.showReferers, "referrers", false, "also report the top referrers")
+	flag.BoolVar(&opts.showUsers, "users", false, "also report the top authenticated users (the CLF auth-user field)")
+	flag.BoolVar(&opts.referersByDomain, "referrer-by-domain", false, "also report the top referrers grouped by registrable domain, e.g. google.com")
+	flag.BoolVar(&opts.showProtocols, "protocols", false, "also report requests by protocol (HTTP/1.1, HTTP/2.0, ...)")
+	flag.BoolVar(&opts.showDirectPaths, "top-empty-referrer-paths", false, "also report the paths most requested without a referrer (bookmarks, typed URLs, scripts)")
+	flag.BoolVar(&opts.showFingerprints, "fingerprints", false, "also report the most common exact method, path and status combinations (repeated exploit attempts)")
+	flag.BoolVar(&opts.methodStatus, "method-status", false, "also print a table of requests per method and status class (e.g. POSTs ending in 5xx)")
+	flag.BoolVar(&opts.showMethods, "methods", false, "also report requests by method (GET, POST, ...), uppercased")
+	flag.BoolVar(&opts.dropEmpty, "drop-empty", false, "leave \"-\" user agents, referrers and sizes out of the reports instead of counting them as (none)")
+	flag.BoolVar(&opts.showSensitive, "sensitive", false, "also report every request to sensitive/admin paths, by client IP")
+	flag.BoolVar(&opts.showMalformed, "malformed", false, "also report requests whose request line has no valid method and path (scanner probes)")
+	flag.StringVar(&opts.sensitiveFile, "sensitive-patterns", "", "file of extra sensitive path fragments, one per line")
+	flag.BoolVar(&opts.showTopErrors, "top-errors", false, "also report the paths with the most 4xx/5xx responses")
+	flag.StringVar(&opts.sortBy, "sort-by", "requests", "rank the IP, path, status and agent reports by requests or by bytes served (falls back to requests without logged sizes)")
+	flag.BoolVar(&opts.showAgentBytes, "top-agents-by-bandwidth", false, "also report user agents ranked by total bytes served")
+	flag.BoolVar(&opts.showStatusBytes, "bandwidth-by-status", false, "also report total and average bytes served per status code")
+	flag.BoolVar(&opts.showImportance, "importance", false, "also report paths scored by traffic and error rate")
+	flag.Float64Var(&opts.importanceWeight, "importance-weight", 1, "error rate exponent in the -importance score")
+	flag.BoolVar(&opts.showSizes, "size-buckets", false, "also report requests by response size bucket")
+	flag.BoolVar(&opts.showLatency, "latency", false, "also report average and p50/p95/p99 request duration, overall and per path")
+	flag.BoolVar(&opts.ipTimeline, "ip-timeline", false, "also show the activity over time of the top IPs")
+	flag.BoolVar(&opts.firstLastSeen, "first-last-seen", false, "annotate each top IP with the time of its first and last request")
+	flag.BoolVar(&opts.sparkline, "sparkline", false, "start the report with a sparkline of requests per time bucket")
+	flag.IntVar(&opts.smooth, "smooth", 1, "average the -sparkline over this many buckets")
+	flag.IntVar(&opts.rpmWindow, "rpm-window", 0, "also report the requests of every minute with their moving average over this many minutes (0 to disable)")
+	flag.BoolVar(&opts.hourStatus, "top-status-per-hour", false, "also show a table of requests per hour of day and status class")
+	flag.BoolVar(&opts.uniquePathsPerIP, "unique-paths-per-ip", false, "also report the IPs that requested the most distinct paths (crawlers)")
+	flag.BoolVar(&opts.agentsPerIP, "agents-per-ip", false, "also report the IPs that sent the most distinct user agents (bots rotating their agent)")
+	flag.IntVar(&opts.maxAgentsPerIP, "max-agents-per-ip", 5, "in -agents-per-ip, flag IPs with more than this many distinct user agents (0 to disable)")
+	flag.BoolVar(&opts.authFailures, "auth-failures", false, "also report the IPs with repeated 401/403 responses (credential stuffing, unauthorized probing)")
+	flag.IntVar(&opts.authFailuresMin, "auth-failures-min", 10, "in -auth-failures, list only IPs with at least this many 401/403 responses")
+	flag.IntVar(&opts.scannerMinPaths, "scanner-min-paths", 100, "in -unique-paths-per-ip, flag IPs with at least this many distinct paths, mostly requested once, as possible scanners (0 to disable)")
+	flag.BoolVar(&opts.topChanges, "top-changes", false, "also report the paths whose traffic changed most between the first and second half of the time range")
+	flag.BoolVar(&opts.bandwidthTimeline, "bandwidth-timeline", false, "also report bytes served per time bucket")
+	flag.DurationVar(&opts.bucketSize, "bucket", time.Hour, "time bucket width for time-based reports")
+	flag.BoolVar(&opts.tui, "tui", false, "explore the results at a line-based command prompt on stdin (top, sort, filter, drill) instead of printing the text reports")
+	flag.BoolVar(&opts.anonymizeIPs, "anonymize-ip", false, "mask the last IPv4 octet / last 80 IPv6 bits, so IP counts are per subnet")
+	flag.IntVar(&opts.approxTop, "approx-top", 0, "count IPs, paths and agents approximately, keeping only this many of each in memory (0 counts exactly)")
+	flag.IntVar(&opts.maxCardinality, "max-cardinality", 0, "max distinct values per count map, extras are counted as (overflow) (0 for no limit)")
+	flag.BoolVar(&opts.ignoreCase, "ignore-case", false, "lowercase paths and user agents before counting")
+	flag.BoolVar(&opts.ignoreCasePaths, "ignore-case-paths", false, "lowercase paths before counting")
+	flag.BoolVar(&opts.normalizeStatus, "normalize-status", false, "count status codes by class (2xx, 3xx, 4xx, 5xx) instead of individually")
+	flag.BoolVar(&opts.syslog, "syslog", false, "strip the RFC 3164 or RFC 5424 syslog header of each line, as for nginx logging to syslog")
+	flag.BoolVar(&opts.joinContinuations, "join-continuations", false, "join lines that do not start with an IP, [timestamp or YYYY-MM-DD date (e.g. stack traces) to the entry before them")
+	flag.BoolVar(&opts.trimTrailingSlash, "normalize-trailing-slash", false, "strip trailing slashes from paths, except the root \"/\", so /about and /about/ count together")
+	flag.BoolVar(&opts.cleanPaths, "clean-paths", false, "canonicalize paths before counting (collapse //, resolve . and ..); raw paths with .. are still reported as traversal probes")
+	flag.BoolVar(&opts.ignoreCaseAgents, "ignore-case-agents", false, "lowercase user agents before counting")
+	flag.BoolVar(&opts.dedupeAgents, "dedupe-agents", false, "strip version numbers from user agents before counting, so Chrome/119 and Chrome/120 count together")
+	flag.BoolVar(&opts.explain, "explain", false, "print the active formats and the parse result of each line to stderr")
+	flag.IntVar(&opts.explainLines, "explain-lines", 20, "number of lines to explain with -explain (0 for all)")
+	flag.BoolVar(&opts.verbose, "verbose", false, "also print the number and the first unparsed lines, with their line numbers")
+	flag.IntVar(&opts.maxSkipSamples, "max-skip-samples", 10, "number of unparsed lines -verbose shows")
+	flag.Float64Var(&opts.failOn5xxPct, "fail-on-5xx-pct", -1, "exit non-zero when the 5xx share of requests exceeds this percentage (negative disables)")
+	flag.StringVar(&opts.compare, "compare", "", "report the counts that changed since a baseline written by an earlier -format json or json-full run")
+	flag.Float64Var(&opts.compareThreshold, "compare-threshold-pct", 0, "only report -compare changes larger than this percentage")
+	flag.StringVar(&opts.compare, "baseline", "", "same as -compare")
+	flag.BoolVar(&opts.failOnChange, "fail-on-change", false, "exit non-zero when -compare finds any change over -compare-threshold-pct")
+	flag.Float64Var(&opts.failOnErrorRise, "fail-on-error-increase", -1, "exit non-zero when the 5xx share of requests rose by more than this many percentage points since the -baseline (negative disables)")
+	flag.StringVar(&opts.webhook, "webhook", "", "POST a JSON alert to this URL when a -fail-on condition fires")
+	flag.StringVar(&thousandsSep, "thousands-sep", "", "separator between digit groups in printed numbers, e.g. \",\"")
+	flag.StringVar(&opts.numberFormat, "number-format", "plain", "printed number style: plain (1234567.89), comma (1,234,567.89) or space (1 234 567,89)")
+	flag.IntVar(&precision, "precision", precision, "decimal places for printed percentages and scores")
+	flag.StringVar(&opts.chart, "chart", "", "also write bar charts of the top items of every category to this SVG or PNG file, by extension")
+	flag.StringVar(&opts.outputDir, "output-dir", "", "write each category's full counts to its own file in this directory")
+	flag.StringVar(&opts.outputFormat, "output-format", "", "file format for -output-dir: csv, json, ndjson or xml (default the -format if it is one of those, else csv)")
+	flag.StringVar(&opts.config, "config", "", "JSON file of flag defaults, keyed by flag name; flags on the command line override it")
+	flag.Parse()
+
+	if opts.config != "" {
+		if err := applyConfig(opts.config); err != nil {
+			return opts, err
+		}
+	}
+
+	// -template alone selects -format template.
+	if opts.templateFile != "" && opts.format == "text" {
+		opts.format = "template"
+	}
+	if _, ok := reporters[opts.format]; !ok {
+		return opts, fmt.Errorf("invalid -format value %q (want text, json, json-full, csv, ndjson, xml, influx, prometheus-textfile or template)", opts.format)
+	}
+	if opts.format == "prometheus-textfile" && opts.output == "" {
+		return opts, fmt.Errorf("-format prometheus-textfile needs -output")
+	}
+	if opts.format == "template" && opts.templateFile == "" {
+		return opts, fmt.Errorf("-format template needs -template")
+	}
+	if opts.templateFile != "" {
+		if opts.format != "template" {
+			return opts, fmt.Errorf("-template needs -format template, got %q", opts.format)
+		}
+		t, err := parseTemplate(opts.templateFile)
+		if err != nil {
+			return opts, err
+		}
+		opts.template = t
+	}
+	if opts.output != "" && opts.format == "text" {
+		return opts, fmt.Errorf("-output needs a non-text -format")
+	}
+	for _, name := range opts.only {
+		if !slices.Contains(categoryNames, name) {
+			return opts, fmt.Errorf("invalid -only value %q (want %s)", name, strings.Join(categoryNames, ", "))
+		}
+	}
+	if opts.head < 0 || opts.tail < 0 {
+		return opts, fmt.Errorf("-head and -tail must not be negative")
+	}
+	if opts.head > 0 && opts.tail > 0 {
+		return opts, fmt.Errorf("-head and -tail are mutually exclusive")
+	}
+	if opts.approxTop < 0 {
+		return opts, fmt.Errorf("-approx-top must not be negative, got %d", opts.approxTop)
+	}
+	if opts.topN < 0 {
+		return opts, fmt.Errorf("-top must not be negative, got %d", opts.topN)
+	}
+	if opts.minRequests < 0 {
+		return opts, fmt.Errorf("-min-requests must not be negative, got %d", opts.minRequests)
+	}
+	if opts.outputFormat == "" {
+		opts.outputFormat = "csv"
+		if slices.Contains(categoryFileFormats, opts.format) {
+			opts.outputFormat = opts.format
+		}
+	}
+	if !slices.Contains(categoryFileFormats, opts.outputFormat) {
+		return opts, fmt.Errorf("invalid -output-format value %q (want csv, json, ndjson or xml)", opts.outputFormat)
+	}
+	if ext := strings.ToLower(filepath.Ext(opts.chart)); opts.chart != "" && ext != ".svg" && ext != ".png" {
+		return opts, fmt.Errorf("invalid -chart file %q (want a .svg or .png file)", opts.chart)
+	}
+	if opts.maxSkipSamples < 0 {
+		return opts, fmt.Errorf("-max-skip-samples must not be negative, got %d", opts.maxSkipSamples)
+	}
+	if opts.bucketSize <= 0 {
+		return opts, fmt.Errorf("-bucket must be positive, got %s", opts.bucketSize)
+	}
+	if opts.compareThreshold < 0 {
+		return opts, fmt.Errorf("-compare-threshold-pct must not be negative, got %s", formatFloat(opts.compareThreshold))
+	}
+	if opts.failOnChange && opts.compare == "" {
+		return opts, fmt.Errorf("-fail-on-change needs -compare")
+	}
+	if opts.failOnErrorRise >= 0 && opts.compare == "" {
+		return opts, fmt.Errorf("-fail-on-error-increase needs -baseline")
+	}
+	if opts.tui && (opts.compact || opts.summaryOnly || opts.format != "text" || opts.emitEntries == "-") {
+		return opts, fmt.Errorf("-tui replaces the text reports on stdout and can't be used with -compact, -summary-only, -emit-entries - or a -format other than text")
+	}
+	if opts.sortBy != "requests" && opts.sortBy != "bytes" {
+		return opts, fmt.Errorf("invalid -sort-by value %q (want requests or bytes)", opts.sortBy)
+	}
+	if opts.agentVersions != "" {
+		family := ""
+		for f := range versionTokens {
+			if strings.EqualFold(f, opts.agentVersions) {
+				family = f
+			}
+		}
+		if strings.EqualFold(opts.agentVersions, "all") {
+			family = "all"
+		}
+		if family == "" {
+			return opts, fmt.Errorf("invalid -group-by-agent-version value %q (want Chrome, Firefox, Safari, Edge or all)", opts.agentVersions)
+		}
+		opts.agentVersions = family
+	}
+	if opts.agentVersions != "" && opts.dedupeAgents {
+		return opts, fmt.Errorf("-dedupe-agents strips the versions -group-by-agent-version reports")
+	}
+	if opts.rpmWindow < 0 {
+		return opts, fmt.Errorf("-rpm-window must not be negative, got %d", opts.rpmWindow)
+	}
+	if opts.smooth < 1 {
+		return opts, fmt.Errorf("-smooth must be at least 1, got %d", opts.smooth)
+	}
+	seps, ok := numberFormats[opts.numberFormat]
+	if !ok {
+		return opts, fmt.Errorf("invalid -number-format value %q (want plain, comma or space)", opts.numberFormat)
+	}
+	// An explicit -thousands-sep overrides the preset's group separator.
+	sepSet := false
+	flag.Visit(func(f *flag.Flag) { sepSet = sepSet || f.Name == "thousands-sep" })
+	if !sepSet {
+		thousandsSep = seps[0]
+	}
+	decimalSep = seps[1]
+	return opts, nil
+}
+
+// applyConfig reads a -config file, a JSON object keyed by flag name that
+// holds flag defaults for sharing an analysis setup, and sets each flag it
+// names that was not given on the command line. Values are strings,
+// numbers or booleans, or arrays of them for repeatable flags such as
+// "url".
+func applyConfig(name string) error {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return fmt.Errorf("error reading config: %w", err)
+	}
+	var c map[string]json.RawMessage
+	if err := json.Unmarshal(data, &c); err != nil {
+		return fmt.Errorf("invalid config %s: %w", name, err)
+	}
+
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	names := make([]string, 0, len(c))
+	for flagName := range c {
+		names = append(names, flagName)
+	}
+	sort.Strings(names)
+	for _, flagName := range names {
+		if flag.Lookup(flagName) == nil || flagName == "config" {
+			return fmt.Errorf("invalid config %s: unknown flag %q", name, flagName)
+		}
+		values, err := configValues(c[flagName])
+		if err != nil {
+			return fmt.Errorf("invalid config %s: %s: %w", name, flagName, err)
+		}
+		if set[flagName] {
+			continue
+		}
+		for _, v := range values {
+			if err := flag.Set(flagName, v); err != nil {
+				return fmt.Errorf("invalid config %s: %s: %w", name, flagName, err)
+			}
+		}
+	}
+	return nil
+}
+
+// configValues converts a config file value into the strings flag.Set
+// takes, one per array element.
+func configValues(raw json.RawMessage) ([]string, error) {
+	var value any
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	if err := dec.Decode(&value); err != nil {
+		return nil, err
+	}
+	items, ok := value.([]any)
+	if !ok {
+		items = []any{value}
+	}
+	values := make([]string, 0, len(items))
+	for _, item := range items {
+		switch v := item.(type) {
+		case string:
+			values = append(values, v)
+		case json.Number:
+			values = append(values, v.String())
+		case bool:
+			values = append(values, strconv.FormatBool(v))
+		default:
+			return nil, fmt.Errorf("want a string, number or boolean, or an array of them")
+		}
+	}
+	return values, nil
+}
+
+// topLabel names a top-N report of n items, e.g. "Top 5", or "All" when n
+// is 0.
+func topLabel(n int) string {
+	if n <= 0 {
+		return "All"
+	}
+	return fmt.Sprintf("Top %d", n)
+}
+
+// printReports prints the text reports selected by opts.
+func (la *LogAnalyzer) printReports(opts options) {
+	la.mu.RLock()
+	defer la.mu.RUnlock()
+	topN := la.topN
+	top := topLabel(topN)
+
+	// Raw and real traffic totals
+	if la.tracksProbes() {
+		fprintProbeSummary(os.Stdout, la.summary(), la.realSummary())
+	}
+	if opts.showRPS {
+		la.printRPS()
+	}
+	if opts.sparkline {
+		la.printTrafficSparkline(opts.smooth)
+	}
+
+	// Top IP addresses, paths, status codes and user agents
+	var text TextReporter
+	if la.trackIPSeen {
+		text.Notes = map[string]func(string) string{"ips": la.ipSeenNote}
+	}
+	text.Report(os.Stdout, la.results(topN))
+
+	// Traffic by OS
+	if opts.showOS {
+		osCounts := groupAgents(la.agentCounts, classifyOS)
+		printResults("Traffic by OS", getTopN(osCounts, 0))
+	}
+
+	// Traffic by browser
+	if opts.showBrowsers {
+		browserCounts := groupAgents(la.agentCounts, classifyBrowser)
+		printResults("Traffic by browser", getTopN(browserCounts, 0))
+	}
+
+	// Browser versions
+	if opts.agentVersions != "" {
+		family := opts.agentVersions
+		if family == "all" {
+			family = "browser"
+		}
+		printResults(fmt.Sprintf("%s %s versions", top, family), getTopN(agentVersions(la.agentCounts, opts.agentVersions), topN))
+	}
+
+	// Top user agents other than browsers
+	if opts.showNonBrowsers {
+		printResults(top+" user agents excluding browsers", getTopN(nonBrowserAgents(la.agentCounts), topN))
+	}
+
+	// Top path prefixes
+	if opts.groupPrefixDepth > 0 {
+		topPrefixes := getTopN(groupByPrefix(la.pathCounts, opts.groupPrefixDepth), topN)
+		printResults(fmt.Sprintf("%s path prefixes (depth %d)", top, opts.groupPrefixDepth), topPrefixes)
+	}
+
+	// Requests by path depth
+	if opts.showDepth {
+		printResults("Requests by path depth", depthHistogram(la.pathCounts))
+	}
+
+	// Top user agents by bandwidth
+	if opts.showAgentBytes {
+		printBytesResults(top+" user agents by bandwidth", getTopN(la.agentBytes, topN))
+	}
+
+	// Bandwidth by status code
+	if opts.showStatusBytes {
+		la.printStatusBytes("Bandwidth by status code")
+	}
+
+	// Top error paths
+	if opts.showTopErrors {
+		printTopErrors(top+" paths by error responses", la.errorPathStatus, topN)
+	}
+
+	// Top paths by importance
+	if opts.showImportance {
+		printImportance(top+" paths by importance (popular and failing)", la.importanceScores(opts.importanceWeight), topN)
+	}
+
+	// Activity of the top IPs
+	if opts.ipTimeline {
+		la.printIPTimelines(topN)
+	}
+
+	// Status classes by hour of day
+	if opts.hourStatus {
+		la.printHourStatus()
+	}
+
+	// Crawlers
+	if opts.uniquePathsPerIP {
+		la.printUniquePathsPerIP(topN, opts.scannerMinPaths)
+	}
+
+	// Bots rotating user agents
+	if opts.agentsPerIP {
+		la.printAgentsPerIP(topN, opts.maxAgentsPerIP)
+	}
+
+	// Traffic shifts over the time range
+	if opts.topChanges {
+		la.printTopChanges(topN)
+	}
+
+	// Requests per minute
+	if opts.rpmWindow > 0 {
+		la.printRequestsPerMinute(opts.rpmWindow)
+	}
+
+	// Bandwidth over time
+	if opts.bandwidthTimeline {
+		// Entries without a timestamp or size are not included.
+		title := fmt.Sprintf("Bytes served per %s", la.seriesStep())
+		printTimeHistogram(title, bucketSeries(la, la.bytesBuckets), la.seriesStart(), la.seriesStep(), formatBytes)
+	}
+
+	// Requests to sensitive paths, however rare
+	if opts.showSensitive {
+		printBreakdown("Requests to sensitive paths (by client IP)", la.sensitiveHits, 0, topN, "requests")
+		if len(la.sensitiveHits) == 0 {
+			fmt.Println("(none found)")
+		}
+	}
+
+	// Raw paths with ".." segments
+	if opts.showSensitive || opts.cleanPaths {
+		printBreakdown("Possible path traversal probes (raw paths with \"..\", by client IP)", la.traversalHits, 0, topN, "requests")
+		if len(la.traversalHits) == 0 {
+			fmt.Println("(none found)")
+		}
+	}
+
+	// Repeated 401 and 403 responses
+	if opts.authFailures {
+		la.printAuthFailures(topN, opts.authFailuresMin)
+	}
+
+	// Malformed requests
+	if opts.showMalformed {
+		la.printMalformed(topN)
+	}
+
+	// Top hosts
+	if opts.showHosts {
+		printResults(top+" hosts by requests", getTopN(la.hostCounts, topN))
+		if len(la.hostCounts) == 0 {
+			fmt.Println("(no vhost field or absolute request URLs found)")
+		}
+	}
+
+	// Requests by protocol
+	if opts.showProtocols {
+		printResults("Requests by protocol", getTopN(la.protocolCounts, 0))
+	}
+
+	// Requests by method
+	if opts.showMethods {
+		printResults("Requests by method", getTopN(la.methodCounts, 0))
+	}
+
+	// Status classes by method
+	if opts.methodStatus {
+		la.printMethodStatus()
+	}
+
+	// Identical repeated requests
+	if opts.showFingerprints {
+		printResults(top+" request fingerprints (method, path and status)", getTopN(la.fingerprintCounts, topN))
+	}
+
+	// Paths hit directly
+	if opts.showDirectPaths {
+		printResults(top+" paths requested without a referrer", getTopN(la.directPaths, topN))
+		if len(la.directPaths) == 0 {
+			fmt.Println("(none found)")
+		}
+	}
+
+	// Top referrers
+	if opts.referersByDomain {
+		printResults(top+" referrer domains", getTopN(groupReferrers(la.refererCounts), topN))
+	} else if opts.showReferers {
+		printResults(top+" referrers", getTopN(la.refererCounts, topN))
+	}
+
+	// Top authenticated users
+	if opts.showUsers {
+		printResults(top+" authenticated users", getTopN(la.userCounts, topN))
+		if len(la.userCounts) == 0 {
+			fmt.Println("(none found)")
+		}
+	}
+
+	// Requests by response size
+	if opts.showSizes {
+		printResults("Requests by response size", sizeHistogram(la.sizeBucketCounts))
+	}
+
+	// Request latency
+	if opts.showLatency {
+		la.printLatency(topN)
+	}
+}
+
+// Results is what a Reporter renders: the top items of every reported
+// category, plus the totals of the whole analysis.
+type Results struct {
+	Categories    []CategoryResults
+	TotalRequests int
+	UniqueIPs     int
+	UniquePaths   int
+	// StatusClasses counts requests by statusClass.
+	StatusClasses map[string]int
+	// Summary holds the headline metrics, as printed by -summary-only, and
+	// RealSummary those of the real traffic when health checks or
+	// monitors are configured.
+	Summary     summary
+	RealSummary *summary
+	// Sources lists the inputs analyzed. TotalLines counts the non-empty
+	// lines read, SkippedLines those that matched no format and
+	// MalformedLines those with an invalid request line. Partial is set
+	// when the analysis was interrupted.
+	Sources        []string
+	TotalLines     int
+	SkippedLines   int
+	MalformedLines int
+	Partial        bool
+}
+
+// Category returns the results of the category named name, such as "ips"
+// or "paths", or empty results if it is not reported. Templates use it as
+// {{(.Category "ips").Items}}.
+func (r Results) Category(name string) CategoryResults {
+	for _, c := range r.Categories {
+		if c.Name == name {
+			return c
+		}
+	}
+	return CategoryResults{Name: name}
+}
+
+// CategoryResults holds the top items of one category. Name is used for
+// JSON keys, Label for the per-item category of CSV and NDJSON rows and
+// Title as the text heading. The XML form is
+// <category name="ip" total="..."><item>...</item></category>.
+type CategoryResults struct {
+	Name  string `xml:"-"`
+	Label string `xml:"name,attr"`
+	Title string `xml:"-"`
+	// Total is the sum of the counts of all items, including those not in
+	// Items; the item percentages are relative to it.
+	Total int          `xml:"total,attr"`
+	Items []ResultItem `xml:"item"`
+	// BelowMin counts the items left out by -min-requests.
+	BelowMin int `xml:"below_min,attr,omitempty"`
+}
+
+// results collects the top n items of every category for a Reporter.
+func (la *LogAnalyzer) results(n int) Results {
+	r := Results{
+		TotalRequests:  la.totalRequests(),
+		UniqueIPs:      len(la.ipCounts),
+		UniquePaths:    len(la.pathCounts),
+		StatusClasses:  make(map[string]int),
+		Summary:        la.summary(),
+		Sources:        la.sources,
+		TotalLines:     la.lines,
+		SkippedLines:   la.skipped,
+		MalformedLines: la.malformed,
+		Partial:        la.partial,
+	}
+	if la.tracksProbes() {
+		realTraffic := la.realSummary()
+		r.RealSummary = &realTraffic
+	}
+	for _, c := range la.categories() {
+		total := sumCounts(c.counts)
+		title := c.title
+		byBytes := la.sortByBytes && len(c.bytes) > 0
+		if byBytes {
+			title = c.bytesTitle
+		}
+		belowMin := 0
+		if c.name == "ips" && la.minRequests > 1 {
+			belowMin = c.keepAtLeast(la.minRequests)
+			title += fmt.Sprintf(" (at least %s requests)", formatInt(la.minRequests))
+		}
+		var items []ResultItem
+		if byBytes {
+			items = withPercent(c.topByBytes(n), total)
+		} else {
+			items = withPercent(getTopN(c.counts, n), total)
+		}
+		if items == nil {
+			items = []ResultItem{}
+		}
+		r.Categories = append(r.Categories, CategoryResults{
+			Name:     c.name,
+			Label:    c.label,
+			Title:    topLabel(n) + " " + title,
+			Total:    total,
+			Items:    items,
+			BelowMin: belowMin,
+		})
+	}
+	for code, count := range la.statusCounts {
+		if class := statusClass(code); class != "" {
+			r.StatusClasses[class] += count
+		}
+	}
+	return r
+}
+
+// version is the tool version recorded in a Report. Release builds set it
+// with -ldflags "-X main.version=...".
+var version = "dev"
+
+// Report is a self-describing analysis, written by -format json-full and
+// returned by Analyze: the results of every category plus where they came
+// from and how many lines went into them.
+type Report struct {
+	Sources     []string  `json:"sources"`
+	AnalyzedAt  time.Time `json:"analyzed_at"`
+	ToolVersion string    `json:"tool_version"`
+	// Partial is set when the analysis was interrupted.
+	Partial bool `json:"partial,omitempty"`
+	// TotalLines counts the non-empty lines read; SkippedLines those that
+	// matched no format and MalformedLines those with an invalid request
+	// line.
+	TotalLines     int            `json:"total_lines"`
+	SkippedLines   int            `json:"skipped_lines"`
+	MalformedLines int            `json:"malformed_lines"`
+	TotalRequests  int            `json:"total_requests"`
+	UniqueIPs      int            `json:"unique_ips"`
+	UniquePaths    int            `json:"unique_paths"`
+	StatusClasses  map[string]int `json:"status_classes"`
+	// Categories holds the top items of every category, keyed by name as
+	// in -format json.
+	Categories map[string]categoryJSON `json:"categories"`
+}
+
+// Analyze reads a whole log from r and returns its Report, the top items
+// of every category plus the totals, without printing anything. It is the
+// entry point for using the analyzer as a library:
+//
+//	report, err := Analyze(strings.NewReader(logs), WithTopN(10))
+func Analyze(r io.Reader, opts ...Option) (*Report, error) {
+	la := NewLogAnalyzer(opts...)
+	if err := la.Err(); err != nil {
+		return nil, err
+	}
+	if err := la.analyzeReader(r); err != nil {
+		return nil, fmt.Errorf("error reading log: %w", err)
+	}
+	report := newReport(la.results(la.topN), time.Now())
+	return &report, nil
+}
+
+// analyzeChunk is the number of lines analyzeReader hands to analyzeLines
+// at a time.
+const analyzeChunk = 4096
+
+// analyzeReader analyzes r line by line, in chunks of analyzeChunk lines,
+// so that a long log is never held in memory whole. With
+// joinContinuations a chunk only ends before the start of an entry, so no
+// entry is split between two chunks.
+func (la *LogAnalyzer) analyzeReader(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<20)
+	first := 1
+	chunk := make([]string, 0, analyzeChunk)
+	flush := func() {
+		la.firstLine = first
+		la.analyzeLines(chunk)
+		first += len(chunk)
+		chunk = chunk[:0]
+	}
+	for scanner.Scan() {
+		line := scanner.Text()
+		if len(chunk) >= analyzeChunk && (!la.joinContinuations || isEntryStart(line)) {
+			flush()
+		}
+		chunk = append(chunk, line)
+	}
+	if len(chunk) > 0 {
+		flush()
+	}
+	return scanner.Err()
+}
+
+// newReport builds the Report of results, analyzed at analyzedAt.
+func newReport(results Results, analyzedAt time.Time) Report {
+	sources := results.Sources
+	if sources == nil {
+		sources = []string{}
+	}
+	r := Report{
+		Sources:        sources,
+		AnalyzedAt:     analyzedAt,
+		ToolVersion:    version,
+		Partial:        results.Partial,
+		TotalLines:     results.TotalLines,
+		SkippedLines:   results.SkippedLines,
+		MalformedLines: results.MalformedLines,
+		TotalRequests:  results.TotalRequests,
+		UniqueIPs:      results.UniqueIPs,
+		UniquePaths:    results.UniquePaths,
+		StatusClasses:  results.StatusClasses,
+		Categories:     make(map[string]categoryJSON, len(results.Categories)),
+	}
+	for _, c := range results.Categories {
+		r.Categories[c.Name] = categoryJSON{Total: c.Total, Items: c.Items, BelowMin: c.BelowMin}
+	}
+	return r
+}
+
+// loadBaseline reads the output of an earlier -format json or json-full
+// run, for -compare. A -format json file has only the categories.
+func loadBaseline(name string) (Report, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return Report{}, fmt.Errorf("error reading baseline: %w", err)
+	}
+	var r Report
+	if err := json.Unmarshal(data, &r); err != nil {
+		return Report{}, fmt.Errorf("error parsing baseline %s: %w", name, err)
+	}
+	if r.Categories == nil {
+		if err := json.Unmarshal(data, &r.Categories); err != nil {
+			return Report{}, fmt.Errorf("error parsing baseline %s: %w", name, err)
+		}
+	}
+	return r, nil
+}
+
+// serverErrorPercent returns the 5xx share of the baseline's requests, in
+// percent. It needs the status class counts of a -format json-full
+// baseline, or a -format json baseline that lists every status code.
+func (r Report) serverErrorPercent() (float64, error) {
+	if r.StatusClasses != nil {
+		if r.TotalRequests == 0 {
+			return 0, nil
+		}
+		return float64(r.StatusClasses["5xx"]) * 100 / float64(r.TotalRequests), nil
+	}
+	status, ok := r.Categories["status"]
+	if !ok || sumItems(status.Items) != status.Total {
+		return 0, fmt.Errorf("baseline has no complete status counts (write it with -format json-full)")
+	}
+	counts := make(map[string]int, len(status.Items))
+	for _, item := range status.Items {
+		counts[item.Value] = item.Count
+	}
+	return serverErrorShare(counts), nil
+}
+
+// sumItems returns the total count of items.
+func sumItems(items []ResultItem) int {
+	total := 0
+	for _, item := range items {
+		total += item.Count
+	}
+	return total
+}
+
+// countChange is the count of one item in the baseline and now.
+type countChange struct {
+	category, value string
+	before, after   int
+}
+
+// percent returns the change relative to the baseline count, +Inf for an
+// item new since the baseline.
+func (c countChange) percent() float64 {
+	if c.before == 0 {
+		return math.Inf(1)
+	}
+	return float64(c.after-c.before) * 100 / float64(c.before)
+}
+
+// compareWith returns the items of every category whose count changed by
+// more than thresholdPct percent since base, largest changes first within
+// each category. It compares the baseline's items and, when the baseline
+// lists every item of a category, the current top la.topN items that are
+// not among them, as new. A baseline cut to its top items says nothing of
+// the others, so they are not compared.
+func (la *LogAnalyzer) compareWith(base Report, thresholdPct float64) []countChange {
+	var changes []countChange
+	for _, c := range la.categories() {
+		baseline, ok := base.Categories[c.name]
+		if !ok {
+			continue
+		}
+		var found []countChange
+		seen := make(map[string]bool, len(baseline.Items))
+		for _, item := range baseline.Items {
+			seen[item.Value] = true
+			found = append(found, countChange{category: c.label, value: item.Value, before: item.Count, after: c.counts[item.Value]})
+		}
+		for _, item := range getTopN(c.counts, la.topN) {
+			if sumItems(baseline.Items) == baseline.Total && !seen[item.Value] {
+				found = append(found, countChange{category: c.label, value: item.Value, after: item.Count})
+			}
+		}
+		found = slices.DeleteFunc(found, func(ch countChange) bool {
+			return ch.after == ch.before || math.Abs(ch.percent()) <= thresholdPct
+		})
+		sort.SliceStable(found, func(i, j int) bool {
+			return abs(found[i].after-found[i].before) > abs(found[j].after-found[j].before)
+		})
+		changes = append(changes, found...)
+	}
+	return changes
+}
+
+// printChanges writes the changes found by compareWith, one per line under
+// its category.
+func printChanges(w io.Writer, baseline string, changes []countChange, thresholdPct float64) {
+	fmt.Fprintf(w, "\nChanges versus %s (by more than %s):\n", baseline, formatPercent(thresholdPct))
+	if len(changes) == 0 {
+		fmt.Fprintln(w, "(none found)")
+		return
+	}
+	category := ""
+	for _, c := range changes {
+		if c.category != category {
+			category = c.category
+			fmt.Fprintf(w, "%s:\n", category)
+		}
+		pct := "new"
+		if c.before > 0 {
+			pct = formatSignedPercent(c.percent())
+		}
+		fmt.Fprintf(w, "  %s: %s -> %s (%s)\n", c.value, formatInt(c.before), formatInt(c.after), pct)
+	}
+}
+
+// Report writes the top la.topN items of every category with r. It can be
+// called while analyze runs, and then reflects the lines counted so far.
+func (la *LogAnalyzer) Report(w io.Writer, r Reporter) error {
+	la.mu.RLock()
+	defer la.mu.RUnlock()
+	return r.Report(w, la.results(la.topN))
+}
+
+// ReportSummary writes only the headline metrics with r, for
+// -summary-only.
+func (la *LogAnalyzer) ReportSummary(w io.Writer, r SummaryReporter) error {
+	la.mu.RLock()
+	defer la.mu.RUnlock()
+	return r.ReportSummary(w, la.results(la.topN))
+}
+
+// Reporter renders Results in one output format.
+type Reporter interface {
+	Report(w io.Writer, results Results) error
+}
+
+// SummaryReporter is a Reporter with a shorter form for -summary-only that
+// renders only Summary and RealSummary. The Prometheus and Influx metrics
+// are a summary already and templates pick the fields they show, so their
+// Reporters have none.
+type SummaryReporter interface {
+	Reporter
+	ReportSummary(w io.Writer, results Results) error
+}
+
+// reporters make the Reporter of every -format value from the options.
+var reporters = map[string]func(opts options) Reporter{
+	"text":                func(options) Reporter { return TextReporter{} },
+	"json":                func(options) Reporter { return JSONReporter{} },
+	"json-full":           func(options) Reporter { return JSONFullReporter{} },
+	"csv":                 func(options) Reporter { return CSVReporter{} },
+	"ndjson":              func(options) Reporter { return NDJSONReporter{} },
+	"xml":                 func(options) Reporter { return XMLReporter{} },
+	"prometheus-textfile": func(options) Reporter { return PrometheusReporter{} },
+	"template":            func(opts options) Reporter { return TemplateReporter{Template: opts.template} },
+	"influx": func(opts options) Reporter {
+		return InfluxReporter{Paths: opts.influxPaths, IPs: opts.influxIPs}
+	},
+}
+
+// TextReporter prints each category as a titled list with colored values.
+// Notes, if set, adds a note to the items of a category, by category name.
+type TextReporter struct {
+	Notes map[string]func(value string) string
+}
+
+// Report implements Reporter.
+func (r TextReporter) Report(w io.Writer, results Results) error {
+	for _, c := range results.Categories {
+		if c.Name == "status" {
+			fprintStatusResults(w, c.Title, c.Items)
+		} else {
+			fprintColoredResults(w, c.Title, c.Items, nil, r.Notes[c.Name])
+		}
+		if c.BelowMin > 0 {
+			fmt.Fprintf(w, "(%s more with fewer requests left out)\n", formatInt(c.BelowMin))
+		}
+	}
+	return nil
+}
+
+// ReportSummary implements SummaryReporter.
+func (TextReporter) ReportSummary(w io.Writer, results Results) error {
+	if results.RealSummary != nil {
+		fprintProbeSummary(w, results.Summary, *results.RealSummary)
+		return nil
+	}
+	s := results.Summary
+	fmt.Fprintln(w, "\nSummary:")
+	fmt.Fprintf(w, "%-14s %s\n", "requests", formatInt(s.TotalRequests))
+	fmt.Fprintf(w, "%-14s %s\n", "unique IPs", formatInt(s.UniqueIPs))
+	fmt.Fprintf(w, "%-14s %s\n", "unique paths", formatInt(s.UniquePaths))
+	fmt.Fprintf(w, "%-14s %s\n", "5xx", formatPercent(s.ServerErrorPct))
+	fmt.Fprintf(w, "%-14s %s\n", "top path", s.TopPath)
+	fmt.Fprintf(w, "%-14s %s\n", "top IP", s.TopIP)
+	return nil
+}
+
+// JSONReporter writes an indented JSON object keyed by category name.
+type JSONReporter struct{}
+
+// Report implements Reporter.
+func (JSONReporter) Report(w io.Writer, results Results) error {
+	doc := make(map[string]categoryJSON, len(results.Categories))
+	for _, c := range results.Categories {
+		doc[c.Name] = categoryJSON{Total: c.Total, Items: c.Items, BelowMin: c.BelowMin}
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(doc)
+}
+
+// ReportSummary implements SummaryReporter.
+func (JSONReporter) ReportSummary(w io.Writer, results Results) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(summaryDocOf(results))
+}
+
+// JSONFullReporter writes the Report of the results, with where they came
+// from and how many lines went into them, as indented JSON.
+type JSONFullReporter struct{}
+
+// Report implements Reporter.
+func (JSONFullReporter) Report(w io.Writer, results Results) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(newReport(results, time.Now()))
+}
+
+// ReportSummary implements SummaryReporter, writing the same summary as
+// JSONReporter.
+func (JSONFullReporter) ReportSummary(w io.Writer, results Results) error {
+	return JSONReporter{}.ReportSummary(w, results)
+}
+
+// CSVReporter writes one category,value,count row per item.
+type CSVReporter struct{}
+
+// Report implements Reporter.
+func (CSVReporter) Report(w io.Writer, results Results) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write([]string{"category", "value", "count"}); err != nil {
+		return err
+	}
+	for _, c := range results.Categories {
+		for _, item := range c.Items {
+			if err := cw.Write([]string{c.Label, item.Value, strconv.Itoa(item.Count)}); err != nil {
+				return err
+			}
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// ReportSummary implements SummaryReporter, with one metric,value row per
+// headline metric.
+func (CSVReporter) ReportSummary(w io.Writer, results Results) error {
+	cw := csv.NewWriter(w)
+	rows := [][]string{{"metric", "value"}}
+	add := func(prefix string, s summary) {
+		rows = append(rows,
+			[]string{prefix + "total_requests", strconv.Itoa(s.TotalRequests)},
+			[]string{prefix + "unique_ips", strconv.Itoa(s.UniqueIPs)},
+			[]string{prefix + "unique_paths", strconv.Itoa(s.UniquePaths)},
+			[]string{prefix + "server_error_pct", strconv.FormatFloat(s.ServerErrorPct, 'f', -1, 64)},
+			[]string{prefix + "top_path", s.TopPath},
+			[]string{prefix + "top_ip", s.TopIP})
+	}
+	add("", results.Summary)
+	if results.RealSummary != nil {
+		add("real_", *results.RealSummary)
+	}
+	cw.WriteAll(rows)
+	return cw.Error()
+}
+
+// NDJSONReporter writes every item as one JSON object per line, e.g.
+// {"category":"ip","value":"1.2.3.4","count":100}.
+type NDJSONReporter struct{}
+
+// Report implements Reporter.
+func (NDJSONReporter) Report(w io.Writer, results Results) error {
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	for _, c := range results.Categories {
+		for _, item := range c.Items {
+			if err := enc.Encode(ndjsonRecord{Category: c.Label, Value: item.Value, Count: item.Count}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// ReportSummary implements SummaryReporter, with the summary on one line.
+func (NDJSONReporter) ReportSummary(w io.Writer, results Results) error {
+	return json.NewEncoder(w).Encode(summaryDocOf(results))
+}
+
+// XMLReporter writes an indented XML document with the totals, the status
+// class counts and one <category> element per category.
+type XMLReporter struct{}
+
+// xmlResults is the document root written by XMLReporter.
+type xmlResults struct {
+	XMLName       xml.Name          `xml:"results"`
+	TotalRequests int               `xml:"total_requests"`
+	UniqueIPs     int               `xml:"unique_ips"`
+	UniquePaths   int               `xml:"unique_paths"`
+	StatusClasses []xmlStatusClass  `xml:"status_classes>class"`
+	Categories    []CategoryResults `xml:"category"`
+}
+
+// xmlStatusClass is one status class count, e.g. <class name="4xx">12</class>.
+type xmlStatusClass struct {
+	Name  string `xml:"name,attr"`
+	Count int    `xml:",chardata"`
+}
+
+// Report implements Reporter.
+func (XMLReporter) Report(w io.Writer, results Results) error {
+	doc := xmlResults{
+		TotalRequests: results.TotalRequests,
+		UniqueIPs:     results.UniqueIPs,
+		UniquePaths:   results.UniquePaths,
+		Categories:    results.Categories,
+	}
+	for class, count := range results.StatusClasses {
+		doc.StatusClasses = append(doc.StatusClasses, xmlStatusClass{Name: class, Count: count})
+	}
+	sort.Slice(doc.StatusClasses, func(i, j int) bool { return doc.StatusClasses[i].Name < doc.StatusClasses[j].Name })
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(doc); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+// ReportSummary implements SummaryReporter, with a <summary> root.
+func (XMLReporter) ReportSummary(w io.Writer, results Results) error {
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(summaryDocOf(results)); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+// TemplateReporter renders Results through a user-supplied text/template,
+// for -template.
+type TemplateReporter struct {
+	Template *template.Template
+}
+
+// templateFuncs are the functions available to -template files, besides
+// the text/template builtins.
+var templateFuncs = template.FuncMap{
+	"formatInt":     formatInt,
+	"formatPercent": formatPercent,
+	"formatBytes":   formatBytes,
+}
+
+// parseTemplate reads and parses a -template file.
+func parseTemplate(name string) (*template.Template, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, fmt.Errorf("error reading template: %w", err)
+	}
+	t, err := template.New(filepath.Base(name)).Funcs(templateFuncs).Parse(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("invalid template: %w", err)
+	}
+	return t, nil
+}
+
+// Report implements Reporter.
+func (r TemplateReporter) Report(w io.Writer, results Results) error {
+	return r.Template.Execute(w, results)
+}
+
+// PrometheusReporter writes totals and status class counts in the
+// Prometheus text exposition format, for node_exporter's textfile
+// collector. All metrics are gauges describing the last analysis run.
+type PrometheusReporter struct{}
+
+// Report implements Reporter.
+func (PrometheusReporter) Report(w io.Writer, results Results) error {
+	classes := make([]string, 0, len(results.StatusClasses))
+	for class := range results.StatusClasses {
+		classes = append(classes, class)
+	}
+	sort.Strings(classes)
+
+	var b strings.Builder
+	gauge := func(name, help string, value float64) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s gauge\n%s %s\n", name, help, name, name, strconv.FormatFloat(value, 'f', -1, 64))
+	}
+	gauge("log_analyzer_requests", "Requests matched in the analyzed log.", float64(results.TotalRequests))
+	gauge("log_analyzer_unique_ips", "Distinct client IPs in the analyzed log.", float64(results.UniqueIPs))
+	gauge("log_analyzer_unique_paths", "Distinct request paths in the analyzed log.", float64(results.UniquePaths))
+	fmt.Fprintf(&b, "# HELP log_analyzer_requests_by_status_class Requests by HTTP status class.\n")
+	fmt.Fprintf(&b, "# TYPE log_analyzer_requests_by_status_class gauge\n")
+	for _, class := range classes {
+		fmt.Fprintf(&b, "log_analyzer_requests_by_status_class{class=%q} %d\n", class, results.StatusClasses[class])
+	}
+	gauge("log_analyzer_last_run_timestamp_seconds", "Unix time of the last analysis run.", float64(time.Now().Unix()))
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// InfluxReporter writes the totals, status classes and top status codes
+// in InfluxDB line protocol, for influx write, e.g.
+// "log_status,code=404 count=1200i 1700000000000000000". Paths and IPs,
+// whose many distinct values are costly as tags, are only written when
+// Paths or IPs is set. Every point has the time of the analysis run.
+type InfluxReporter struct {
+	Paths, IPs bool
+}
+
+// influxTag escapes a tag value for line protocol.
+var influxTag = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `, "\n", `\n`)
+
+// Report implements Reporter.
+func (r InfluxReporter) Report(w io.Writer, results Results) error {
+	ts := time.Now().UnixNano()
+	var b strings.Builder
+	fmt.Fprintf(&b, "log_totals requests=%di,unique_ips=%di,unique_paths=%di %d\n",
+		results.TotalRequests, results.UniqueIPs, results.UniquePaths, ts)
+	classes := make([]string, 0, len(results.StatusClasses))
+	for class := range results.StatusClasses {
+		classes = append(classes, class)
+	}
+	sort.Strings(classes)
+	for _, class := range classes {
+		fmt.Fprintf(&b, "log_status_class,class=%s count=%di %d\n", influxTag.Replace(class), results.StatusClasses[class], ts)
+	}
+	for _, m := range []struct {
+		measurement, tag, category string
+		enabled                    bool
+	}{
+		{"log_status", "code", "status", true},
+		{"log_path", "path", "paths", r.Paths},
+		{"log_ip", "ip", "ips", r.IPs},
+	} {
+		if !m.enabled {
+			continue
+		}
+		for _, item := range results.Category(m.category).Items {
+			if item.Value == "" {
+				continue
+			}
+			fmt.Fprintf(&b, "%s,%s=%s count=%di %d\n", m.measurement, m.tag, influxTag.Replace(item.Value), item.Count, ts)
+		}
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// nonstandardStatus are the documented status codes that servers log but
+// that are never sent as HTTP responses, with what they mean. statusClass
+// puts them in their own class rather than with e.g. genuine 4xx errors.
+var nonstandardStatus = map[string]string{
+	"000": "no response sent",
+	"444": "connection closed without response",
+	"499": "client closed request",
+}
+
+// nonstandardClass is the status class of the nonstandardStatus codes.
+const nonstandardClass = "nonstandard"
+
+// statusClass returns the class of a status code, e.g. "4xx" for "404",
+// nonstandardClass for the nonstandardStatus codes, or "" when the code
+// does not start with a digit.
+func statusClass(code string) string {
+	if code == "" || !isDigit(code[0]) {
+		return ""
+	}
+	if _, ok := nonstandardStatus[code]; ok {
+		return nonstandardClass
+	}
+	return code[:1] + "xx"
+}
+
+// statusFamily returns the statusClass of a status code, e.g. "4xx" for
+// "404" and nonstandardClass for "499", or the code unchanged when it does
+// not start with a digit.
+func statusFamily(code string) string {
+	if class := statusClass(code); class != "" {
+		return class
+	}
+	return code
+}
+
+// writeFileAtomic writes a file through write by creating a temporary file
+// in the same directory and renaming it into place, so readers such as
+// the node_exporter textfile collector never see a partial file.
+func writeFileAtomic(path string, write func(io.Writer) error) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("error creating temporary file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := write(tmp); err != nil {
+		tmp.Close()
+		return fmt.Errorf("error writing %s: %w", path, err)
+	}
+	if err := tmp.Chmod(0o644); err != nil {
+		tmp.Close()
+		return fmt.Errorf("error writing %s: %w", path, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("error writing %s: %w", path, err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("error replacing %s: %w", path, err)
+	}
+	return nil
+}
+
+// ndjsonRecord is one line of -format ndjson output.
+type ndjsonRecord struct {
+	Category string `json:"category"`
+	Value    string `json:"value"`
+	Count    int    `json:"count"`
+}
+
+// dryRunAll runs dryRun on the first lines of every URL, printing to
+// stdout. It reports whether every input could be read and had at least
+// one matching line.
+func dryRunAll(ctx context.Context, la *LogAnalyzer, urls []string) bool {
+	ok := true
+	for _, u := range urls {
+		fmt.Printf("\nChecking %s\n", u)
+		body, err := openLogURL(ctx, u)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			ok = false
+			continue
+		}
+		err = eachLogMember(body, func(name string, r io.Reader) error {
+			if name != "" {
+				fmt.Printf("%s in the archive:\n", name)
+			}
+			_, matched, err := la.dryRun(os.Stdout, r, dryRunLines)
+			if err == nil && matched == 0 {
+				fmt.Println("Error: no line matched the active formats (see -explain)")
+				ok = false
+			}
+			return err
+		})
+		body.Close()
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			ok = false
+		}
+	}
+	return ok
+}
+
+// fatalf prints a fatal error to stderr and exits with status 1.
+func fatalf(format string, args ...any) {
+	fmt.Fprintf(os.Stderr, "Fatal Error: "+format+"\n", args...)
+	os.Exit(1)
+}
+
+// writeReport writes the report of a non-text -format to -output, or to
+// stdout.
+func writeReport(analyzer *LogAnalyzer, opts options) error {
+	reporter := reporters[opts.format](opts)
+	write := func(w io.Writer) error {
+		if s, ok := reporter.(SummaryReporter); ok && opts.summaryOnly {
+			return analyzer.ReportSummary(w, s)
+		}
+		return analyzer.Report(w, reporter)
+	}
+	if opts.output != "" {
+		return writeFileAtomic(opts.output, write)
+	}
+	return write(os.Stdout)
+}
+
+func main() {
+	opts, err := parseOptions()
+	if err != nil {
+		fatalf("%v", err)
+	}
+
+	// Machine-readable formats own stdout, so progress goes to stderr and
+	// color is never used.
+	if opts.format != "text" || opts.compact || opts.emitEntries == "-" {
+		statusOut = os.Stderr
+		opts.colorMode = "never"
+	}
+	useColor, err = colorEnabled(opts.colorMode)
+	if err != nil {
+		fatalf("%v", err)
+	}
+
+	// 1. Initialize the analyzer
+	analyzerOpts := []Option{
+		WithTopN(opts.topN),
+		WithExcludePaths(opts.excludePaths...),
+		WithHealthPaths(opts.healthPaths...),
+		WithMonitorIPs(opts.monitorIPs...),
+		WithVHost(opts.filterVHost),
+		WithOnly(opts.only...),
+		WithMaxCardinality(opts.maxCardinality),
+		WithFoldCase(opts.ignoreCase || opts.ignoreCasePaths, opts.ignoreCase || opts.ignoreCaseAgents),
+	}
+	if opts.customRegex != "" {
+		r, err := regexp.Compile(opts.customRegex)
+		if err != nil {
+			fatalf("invalid custom regex: %v", err)
+		}
+		analyzerOpts = append(analyzerOpts, WithRegex(r))
+	}
+	whitelist, err := ipListValues(opts.ipWhitelist)
+	if err != nil {
+		fatalf("-ip-whitelist: %v", err)
+	}
+	analyzerOpts = append(analyzerOpts, WithIPWhitelist(whitelist...))
+	if opts.includeStatus != "" {
+		analyzerOpts = append(analyzerOpts, WithIncludeStatus(opts.includeStatus))
+	}
+	if opts.excludeStatus != "" {
+		analyzerOpts = append(analyzerOpts, WithExcludeStatus(opts.excludeStatus))
+	}
+	if opts.statusRegex != "" {
+		r, err := regexp.Compile(opts.statusRegex)
+		if err != nil {
+			fatalf("invalid -status-regex: %v", err)
+		}
+		analyzerOpts = append(analyzerOpts, WithStatusRegex(r))
+	}
+	if opts.sensitiveFile != "" {
+		extra, err := loadPatterns(opts.sensitiveFile)
+		if err != nil {
+			fatalf("%v", err)
+		}
+		analyzerOpts = append(analyzerOpts, WithSensitivePatterns(extra...))
+	}
+	if opts.approxTop > 0 {
+		analyzerOpts = append(analyzerOpts, WithApproxTop(opts.approxTop))
+	}
+	for _, o := range []struct {
+		set bool
+		opt Option
+	}{
+		{opts.anonymizeIPs, WithAnonymizeIPs()},
+		{opts.dropEmpty, WithDropEmpty()},
+		{opts.dedupeAgents, WithDedupeAgents()},
+		{opts.cleanPaths, WithCleanPaths()},
+		{opts.trimTrailingSlash, WithTrimTrailingSlash()},
+		{opts.normalizeStatus, WithNormalizeStatus()},
+	} {
+		if o.set {
+			analyzerOpts = append(analyzerOpts, o.opt)
+		}
+	}
+	analyzer := NewLogAnalyzer(analyzerOpts...)
+	if err := analyzer.Err(); err != nil {
+		fatalf("%v", err)
+	}
+	if opts.verbose {
+		analyzer.maxSkipSamples = opts.maxSkipSamples
+	}
+	analyzer.joinContinuations = opts.joinContinuations
+	analyzer.syslog = opts.syslog
+	analyzer.bucketSize = opts.bucketSize
+	analyzer.sortByBytes = opts.sortBy == "bytes"
+	analyzer.minRequests = opts.minRequests
+	analyzer.trackIPTimeline = opts.ipTimeline
+	analyzer.trackIPSeen = opts.firstLastSeen
+	analyzer.trackPathTimes = opts.topChanges
+	analyzer.trackIPPaths = opts.uniquePathsPerIP
+	analyzer.trackIPAgents = opts.agentsPerIP
+	analyzer.trackLatency = opts.showLatency
+	if opts.explain {
+		analyzer.explainOut = os.Stderr
+		analyzer.explainLines = opts.explainLines
+		analyzer.describeFormats(os.Stderr)
+	}
+	var baseline Report
+	if opts.compare != "" {
+		baseline, err = loadBaseline(opts.compare)
+		if err == nil && opts.failOnErrorRise >= 0 {
+			_, err = baseline.serverErrorPercent()
+		}
+		if err != nil {
+			fatalf("%v", err)
+		}
+	}
+	if opts.dryRun {
+		if !dryRunAll(context.Background(), analyzer, logURLs(opts.urls)) {
+			os.Exit(1)
+		}
+		return
+	}
+
+	var entryDest *os.File
+	var entryFile *bufio.Writer
+	switch opts.emitEntries {
+	case "":
+	case "-":
+		entryDest = os.Stdout
+	default:
+		f, err := os.Create(opts.emitEntries)
+		if err != nil {
+			fatalf("error creating entries file: %v", err)
+		}
+		entryDest = f
+	}
+	if entryDest != nil {
+		entryFile = bufio.NewWriter(entryDest)
+		enc := json.NewEncoder(entryFile)
+		enc.SetEscapeHTML(false)
+		analyzer.entryOut = enc
+		analyzer.entryLines = opts.emitLineNumbers
+	}
+
+	// On the first interrupt, stop and report what has been analyzed so
+	// far; a second interrupt exits immediately.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	interrupts := make(chan os.Signal, 2)
+	signal.Notify(interrupts, os.Interrupt)
+	go func() {
+		<-interrupts
+		fmt.Fprintln(os.Stderr, "\nInterrupted: stopping with partial results (interrupt again to exit now)")
+		analyzer.stop.Store(true)
+		cancel()
+		<-interrupts
+		os.Exit(130)
+	}()
+
+	// 2. Download each log file and run analysis. A failed download does
+	// not stop the others; the failures are listed at the end.
+	urls := logURLs(opts.urls)
+	var failures []string
+	for _, u := range urls {
+		if ctx.Err() != nil {
+			analyzer.partial = true
+			break
+		}
+		var members []logMember
+		if opts.head > 0 || opts.tail > 0 {
+			members, err = downloadLogSample(ctx, u, opts.head, opts.tail)
+		} else {
+			var logContent string
+			logContent, err = downloadLogFile(ctx, u)
+			if err == nil {
+				members, err = logMembers(logContent)
+			}
+		}
+		if err != nil && ctx.Err() != nil {
+			// The interrupt aborted this download: stop with what has
+			// been analyzed, rather than failing the URL.
+			analyzer.partial = true
+			break
+		}
+		if err != nil {
+			fmt.Fprintf(statusOut, "Error: %v\n", err)
+			failures = append(failures, fmt.Sprintf("%s: %v", u, err))
+			continue
+		}
+		for _, m := range members {
+			source := u
+			if m.name != "" {
+				source += "#" + m.name
+				fmt.Fprintf(statusOut, "Analyzing %s from the archive\n", m.name)
+			}
+			analyzer.source, analyzer.firstLine = source, m.firstLine
+			analyzer.sources = append(analyzer.sources, source)
+			analyzer.analyze(m.content)
+			if analyzer.partial {
+				break
+			}
+		}
+		if analyzer.partial {
+			break
+		}
+	}
+	if entryFile != nil {
+		// Close the entries file here rather than deferring it: the exits
+		// below skip deferred calls, and a failed close can mean lost
+		// entries.
+		err := entryFile.Flush()
+		if entryDest != os.Stdout {
+			if cerr := entryDest.Close(); err == nil {
+				err = cerr
+			}
+		}
+		if err != nil && analyzer.entryErr == nil {
+			analyzer.entryErr = err
+		}
+		if analyzer.entryErr != nil {
+			fmt.Fprintf(os.Stderr, "Error: writing parsed entries: %v\n", analyzer.entryErr)
+		}
+	}
+	if len(failures) == len(urls) {
+		for _, f := range failures {
+			fmt.Fprintf(os.Stderr, "  %s\n", f)
+		}
+		fatalf("no log file could be downloaded")
+	}
+	if opts.emitEntries == "-" {
+		// The entries replace the reports, but the skipped lines still
+		// say which lines are missing from them.
+		if opts.verbose {
+			analyzer.printSkipped(statusOut)
+		}
+		if analyzer.entryErr != nil {
+			os.Exit(1)
+		}
+		return
+	}
+	analyzer.warnMixedFormats()
+	if opts.verbose {
+		analyzer.printSkipped(statusOut)
+	}
+	analyzer.warnOverflow()
+	if analyzer.includeStatus != nil || analyzer.excludeStatus != nil || analyzer.statusRegex != nil {
+		fmt.Fprintf(statusOut, "Status filter: kept %s requests, left out %s\n", formatInt(analyzer.totalRequests()), formatInt(analyzer.statusFiltered))
+	}
+	if folded := analyzer.foldedFields(); len(folded) > 0 {
+		fmt.Fprintf(statusOut, "Case-folding applied to: %s\n", strings.Join(folded, ", "))
+	}
+	if analyzer.cleanPaths {
+		fmt.Fprintln(statusOut, "Path cleaning applied (collapsed //, resolved . and ..)")
+	}
+	if analyzer.partial {
+		fmt.Fprintln(statusOut, "\nNote: analysis was interrupted, results are partial.")
+	}
+	// Empty reports explain nothing, so say why there are none and fail.
+	// Machine-readable formats still get a valid, empty document.
+	if analyzer.totalRequests() == 0 {
+		if analyzer.matched > 0 {
+			fmt.Fprintf(statusOut, "\nNo log entries left (%s lines matched, the filters left out all of them).\n", formatInt(analyzer.matched))
+		} else {
+			fmt.Fprintln(statusOut, "\nNo log entries found (0 lines matched).")
+		}
+		if analyzer.skipped > 0 && !opts.verbose {
+			analyzer.printSkipped(statusOut)
+		}
+		if opts.format != "text" && !opts.compact {
+			if err := writeReport(analyzer, opts); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			}
+		}
+		os.Exit(1)
+	}
+
+	// 3. Print the reports. A report that cannot be written fails the run,
+	// but the alerts below are still checked and sent.
+	failed := analyzer.entryErr != nil
+	if opts.tui {
+		// The explorer, started once everything below is done, takes the
+		// place of the text reports.
+	} else if opts.compact {
+		line := analyzer.summary().compact()
+		if analyzer.tracksProbes() {
+			line += " " + analyzer.realSummary().fields("real_")
+		}
+		fmt.Println(line)
+	} else if opts.format == "text" && opts.summaryOnly {
+		analyzer.ReportSummary(os.Stdout, TextReporter{})
+		if opts.showRPS {
+			analyzer.printRPS()
+		}
+	} else if opts.format == "text" {
+		analyzer.printReports(opts)
+	} else {
+		if err := writeReport(analyzer, opts); err != nil {
+			failed = true
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		}
+	}
+
+	// 4. Write the full per-category counts
+	if opts.outputDir != "" {
+		if err := writeCategoryFiles(opts.outputDir, opts.outputFormat, analyzer.categories()); err != nil {
+			failed = true
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		} else {
+			fmt.Fprintf(statusOut, "\nWrote category files to %s\n", opts.outputDir)
+		}
+	}
+
+	// 5. Render the charts
+	if opts.chart != "" {
+		render := writeChart
+		if strings.EqualFold(filepath.Ext(opts.chart), ".png") {
+			render = writeChartPNG
+		}
+		err := writeFileAtomic(opts.chart, func(w io.Writer) error {
+			return render(w, analyzer.categories(), analyzer.topN)
+		})
+		if err != nil {
+			failed = true
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		} else {
+			fmt.Fprintf(statusOut, "\nWrote charts to %s\n", opts.chart)
+		}
+	}
+
+	// 6. Check alert thresholds. Every condition that fires fails the
+	// run and is posted to the -webhook.
+	alert := func(payload alertPayload) {
+		failed = true
+		if opts.webhook == "" {
+			return
+		}
+		if err := postWebhook(opts.webhook, payload); err != nil {
+			fmt.Fprintf(statusOut, "Error: %v\n", err)
+		}
+	}
+	if opts.failOn5xxPct >= 0 {
+		if pct := analyzer.serverErrorPercent(); pct > opts.failOn5xxPct {
+			fmt.Fprintf(statusOut, "\nAlert: 5xx responses are %s of requests (threshold %s)\n", formatPercent(pct), formatPercent(opts.failOn5xxPct))
+			alert(analyzer.newAlert("fail-on-5xx-pct", pct, opts.failOn5xxPct))
+		}
+	}
+
+	// 7. Compare with the baseline
+	if opts.compare != "" {
+		changes := analyzer.compareWith(baseline, opts.compareThreshold)
+		printChanges(statusOut, opts.compare, changes, opts.compareThreshold)
+		if opts.failOnChange && len(changes) > 0 {
+			fmt.Fprintf(statusOut, "\nAlert: %s counts changed by more than %s since %s\n", formatInt(len(changes)), formatPercent(opts.compareThreshold), opts.compare)
+			payload := analyzer.newAlert("fail-on-change", float64(len(changes)), opts.compareThreshold)
+			for _, c := range changes {
+				payload.Changes = append(payload.Changes, alertChange{Category: c.category, Value: c.value, Before: c.before, After: c.after})
+			}
+			alert(payload)
+		}
+		if before, err := baseline.serverErrorPercent(); err == nil {
+			after := analyzer.serverErrorPercent()
+			fmt.Fprintf(statusOut, "\n5xx share of requests: %s in %s, %s now (%s)\n", formatPercent(before), opts.compare, formatPercent(after), formatPoints(after-before))
+			if opts.failOnErrorRise >= 0 && after-before > opts.failOnErrorRise {
+				fmt.Fprintf(statusOut, "\nAlert: 5xx share rose by %s points since %s (threshold %s points)\n", formatFloat(after-before), opts.compare, formatFloat(opts.failOnErrorRise))
+				alert(analyzer.newAlert("fail-on-error-increase", after-before, opts.failOnErrorRise))
+			}
+		}
+	}
+
+	if len(failures) > 0 {
+		fmt.Fprintf(statusOut, "\nFailed to download %s of %s log files:\n", formatInt(len(failures)), formatInt(len(urls)))
+		for _, f := range failures {
+			fmt.Fprintf(statusOut, "  %s\n", f)
+		}
+	}
+
+	fmt.Fprintln(statusOut, "\nAnalysis complete.")
+	if opts.tui {
+		runExplorer(os.Stdin, os.Stdout, analyzer)
+	}
+	if failed {
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,1119 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"maps"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"text/template"
+	"time"
+	"unicode/utf8"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// combinedLine returns a combined log line for ip, path and status at the
+// given [...] timestamp.
+func combinedLine(ip, timestamp, path, status string) string {
+	return ip + ` - - [` + timestamp + `] "GET ` + path + ` HTTP/1.1" ` + status + ` 512 "-" "curl/8.4.0"`
+}
+
+// captureStdout runs f and returns what it printed to stdout.
+func captureStdout(t *testing.T, f func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+	done := make(chan string)
+	go func() {
+		out, _ := io.ReadAll(r)
+		done <- string(out)
+	}()
+	f()
+	w.Close()
+	return <-done
+}
+
+func TestOutOfRangeTimestamps(t *testing.T) {
+	for _, ts := range []string{"10/Oct/1000:13:55:36 +0000", "10/Oct/9999:13:55:36 +0000"} {
+		la := NewLogAnalyzer()
+		la.trackIPTimeline = true
+		la.analyzeLines([]string{
+			combinedLine("1.2.3.4", "10/Oct/2023:13:55:36 +0000", "/a", "200"),
+			combinedLine("1.2.3.4", ts, "/a", "200"),
+		})
+		if got := la.totalRequests(); got != 2 {
+			t.Fatalf("%s: counted %d requests, want 2", ts, got)
+		}
+		if !la.lastTime.Equal(la.firstTime) {
+			t.Errorf("%s: time range %s to %s, want the out-of-range timestamp left out", ts, la.firstTime, la.lastTime)
+		}
+		captureStdout(t, func() {
+			la.printTrafficSparkline(1)
+			la.printIPTimelines(5)
+		})
+	}
+}
+
+func TestLongTimeRangeSeries(t *testing.T) {
+	la := NewLogAnalyzer()
+	la.trackIPTimeline = true
+	la.analyzeLines([]string{
+		combinedLine("1.2.3.4", "01/Jan/1700:00:00:00 +0000", "/a", "200"),
+		combinedLine("1.2.3.4", "31/Dec/2199:23:59:59 +0000", "/a", "200"),
+	})
+	series := bucketSeries(la, la.requestBuckets)
+	if len(series) > maxSeriesPoints+1 {
+		t.Fatalf("series has %d points, want at most %d", len(series), maxSeriesPoints+1)
+	}
+	if series[0] != 1 || series[len(series)-1] != 1 {
+		t.Errorf("series starts with %d and ends with %d, want 1 and 1", series[0], series[len(series)-1])
+	}
+	out := captureStdout(t, func() { la.printTrafficSparkline(1) })
+	if !strings.Contains(out, "1700-01-01") {
+		t.Errorf("sparkline does not cover the range:\n%s", out)
+	}
+}
+
+func TestBandwidthTimelineLongRange(t *testing.T) {
+	la := NewLogAnalyzer()
+	la.analyzeLines([]string{
+		combinedLine("1.2.3.4", "10/Oct/2023:13:55:36 +0000", "/a", "200"),
+		combinedLine("1.2.3.4", "10/Oct/1000:13:55:36 +0000", "/a", "200"),
+		combinedLine("1.2.3.4", "10/Oct/1800:13:55:36 +0000", "/a", "200"),
+	})
+	series := bucketSeries(la, la.bytesBuckets)
+	if len(series) > maxSeriesPoints+1 {
+		t.Fatalf("series has %d points, want at most %d", len(series), maxSeriesPoints+1)
+	}
+	total := int64(0)
+	for _, v := range series {
+		total += v
+	}
+	if total != 1024 {
+		t.Errorf("series sums to %d bytes, want 1024", total)
+	}
+	out := captureStdout(t, func() {
+		printTimeHistogram("Bytes", series, la.seriesStart(), la.seriesStep(), formatBytes)
+	})
+	if !strings.Contains(out, "1800-") {
+		t.Errorf("histogram does not start in 1800:\n%s", out)
+	}
+}
+
+func TestRequestsPerMinuteSkew(t *testing.T) {
+	la := NewLogAnalyzer()
+	la.analyzeLines([]string{
+		combinedLine("1.2.3.4", "10/Oct/2000:13:55:36 +0000", "/a", "200"),
+		combinedLine("1.2.3.4", "10/Oct/2023:13:55:36 +0000", "/a", "200"),
+		combinedLine("1.2.3.4", "10/Oct/2023:13:56:10 +0000", "/a", "200"),
+	})
+	out := captureStdout(t, func() { la.printRequestsPerMinute(3) })
+	want := []string{
+		"Requests per minute, with a 3-minute moving average:",
+		"2000-10-10 13:55        1 avg 1.00",
+		"2000-10-10 13:56        0 avg 0.50",
+		"2000-10-10 13:57        0 avg 0.33",
+		"(12095997 minutes without requests)",
+		"2023-10-10 13:55        1 avg 0.33",
+		"2023-10-10 13:56        1 avg 0.67",
+	}
+	if got := strings.Split(strings.TrimSpace(out), "\n"); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestSparklineOutOfRangeTimestamps(t *testing.T) {
+	la := NewLogAnalyzer()
+	la.analyzeLines([]string{
+		combinedLine("1.2.3.4", "10/Oct/1000:13:55:36 +0000", "/a", "200"),
+		combinedLine("1.2.3.4", "01/Jan/1700:00:00:00 +0000", "/a", "200"),
+		combinedLine("1.2.3.4", "10/Oct/2023:13:55:36 +0000", "/a", "200"),
+		combinedLine("1.2.3.4", "10/Oct/9999:13:55:36 +0000", "/a", "200"),
+	})
+	out := captureStdout(t, func() { la.printReports(options{sparkline: true, smooth: 3}) })
+	line := ""
+	for _, l := range strings.Split(out, "\n") {
+		if strings.HasPrefix(l, "Traffic ") {
+			line = l
+		}
+	}
+	if !strings.HasPrefix(line, "Traffic 1700-01-01 00:00:00 +0000 to 2023-10-10 13:55:36 +0000: ") {
+		t.Fatalf("unexpected sparkline line %q", line)
+	}
+	spark, _, _ := strings.Cut(strings.SplitN(line, ": ", 2)[1], " ")
+	if n := utf8.RuneCountInString(spark); n > maxSeriesPoints+1 {
+		t.Errorf("sparkline has %d points, want at most %d", n, maxSeriesPoints+1)
+	}
+}
+
+func TestPrintChangesNumberFormat(t *testing.T) {
+	defer func(p int, ts, ds string) { precision, thousandsSep, decimalSep = p, ts, ds }(precision, thousandsSep, decimalSep)
+	precision, thousandsSep, decimalSep = 3, " ", ","
+	var b strings.Builder
+	printChanges(&b, "before.json", []countChange{
+		{category: "paths", value: "/a", before: 3000, after: 1000},
+		{category: "paths", value: "/b", before: 0, after: 5},
+	}, 25)
+	want := "\nChanges versus before.json (by more than 25,000%):\npaths:\n" +
+		"  /a: 3 000 -> 1 000 (-66,667%)\n" +
+		"  /b: 0 -> 5 (new)\n"
+	if b.String() != want {
+		t.Errorf("got %q, want %q", b.String(), want)
+	}
+}
+
+// gzipped returns s gzip-compressed.
+func gzipped(t *testing.T, s string) string {
+	t.Helper()
+	var b bytes.Buffer
+	zw := gzip.NewWriter(&b)
+	if _, err := zw.Write([]byte(s)); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return b.String()
+}
+
+// tarball returns a tar archive of files, given as name and content pairs.
+func tarball(t *testing.T, files ...string) string {
+	t.Helper()
+	var b bytes.Buffer
+	tw := tar.NewWriter(&b)
+	for i := 0; i < len(files); i += 2 {
+		hdr := &tar.Header{Name: files[i], Mode: 0o644, Size: int64(len(files[i+1])), Typeflag: tar.TypeReg}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(files[i+1])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return b.String()
+}
+
+// numberedLines returns n lines "line 1" to "line n".
+func numberedLines(n int) string {
+	lines := make([]string, n)
+	for i := range lines {
+		lines[i] = fmt.Sprintf("line %d", i+1)
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+func TestSampleCompressedSources(t *testing.T) {
+	log := numberedLines(1000)
+	archive := gzipped(t, tarball(t, "a.log", log, "b.log.gz", gzipped(t, log), "bin.dat", "\x00\x01"))
+	for _, tc := range []struct {
+		name, source string
+		members      []string
+	}{
+		{"plain", log, []string{""}},
+		{"gzip", gzipped(t, log), []string{""}},
+		{"tar.gz", archive, []string{"a.log", "b.log.gz"}},
+	} {
+		for _, s := range []struct {
+			head, tail  int
+			first, last string
+			firstLine   int
+		}{
+			{head: 3, first: "line 1", last: "line 3", firstLine: 1},
+			{tail: 3, first: "line 998", last: "line 1000", firstLine: 998},
+		} {
+			var names []string
+			err := eachLogMember(strings.NewReader(tc.source), func(name string, r io.Reader) error {
+				names = append(names, name)
+				content, firstLine, err := sampleLines(r, s.head, s.tail)
+				if err != nil {
+					return err
+				}
+				if firstLine != s.firstLine {
+					t.Errorf("%s %s, head %d tail %d: first line %d, want %d", tc.name, name, s.head, s.tail, firstLine, s.firstLine)
+				}
+				lines := strings.Split(content, "\n")
+				if len(lines) != 3 || lines[0] != s.first || lines[2] != s.last {
+					t.Errorf("%s %s, head %d tail %d: got %q", tc.name, name, s.head, s.tail, lines)
+				}
+				return nil
+			})
+			if err != nil {
+				t.Fatalf("%s: %v", tc.name, err)
+			}
+			if strings.Join(names, ",") != strings.Join(tc.members, ",") {
+				t.Errorf("%s: members %q, want %q", tc.name, names, tc.members)
+			}
+		}
+
+		members, err := logMembers(tc.source)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		for _, m := range members {
+			if m.content != log {
+				t.Errorf("%s %s: content differs from the log", tc.name, m.name)
+			}
+		}
+	}
+}
+
+func TestDryRunGzip(t *testing.T) {
+	source := gzipped(t, combinedLine("1.2.3.4", "10/Oct/2023:13:55:36 +0000", "/a", "200")+"\n")
+	la := NewLogAnalyzer()
+	err := eachLogMember(strings.NewReader(source), func(name string, r io.Reader) error {
+		read, matched, err := la.dryRun(io.Discard, r, dryRunLines)
+		if read != 1 || matched != 1 {
+			t.Errorf("dry run read %d and matched %d lines, want 1 and 1", read, matched)
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEmitLineNumbers(t *testing.T) {
+	var b bytes.Buffer
+	la := NewLogAnalyzer()
+	la.entryOut = json.NewEncoder(&b)
+	la.entryLines = true
+	la.source, la.firstLine = "http://example.com/logs.tar#a.log", 19999
+	la.maxSkipSamples = 10
+	la.analyzeLines([]string{
+		"garbage",
+		combinedLine("1.2.3.4", "10/Oct/2023:13:55:36 +0000", "/a", "200"),
+	})
+	var got numberedEntry
+	if err := json.Unmarshal(b.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Source != la.source || got.Line != 20000 || got.Path != "/a" {
+		t.Errorf("emitted source %q line %d path %q, want %q line 20000 path /a", got.Source, got.Line, got.Path, la.source)
+	}
+	if len(la.skipSamples) != 1 || la.skipSamples[0].number != 19999 {
+		t.Errorf("skipped lines %+v, want line 19999", la.skipSamples)
+	}
+}
+
+// sampleLog returns n combined log lines with a skewed mix of IPs, paths,
+// methods, status codes and agents, the same for every call.
+func sampleLog(n int) []string {
+	r := rand.New(rand.NewSource(1))
+	methods := []string{"GET", "GET", "GET", "POST", "HEAD"}
+	statuses := []string{"200", "200", "200", "301", "304", "404", "499", "500"}
+	agents := []string{
+		"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/119.0.0.0 Safari/537.36",
+		"Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.0 Safari/605.1.15",
+		"curl/8.4.0",
+		"-",
+	}
+	lines := make([]string, n)
+	for i := range lines {
+		ip := fmt.Sprintf("10.0.%d.%d", r.Intn(4), r.Intn(50))
+		path := fmt.Sprintf("/page/%d?id=%d", int(r.ExpFloat64()*10), r.Intn(100))
+		ts := fmt.Sprintf("10/Oct/2023:%02d:%02d:%02d +0000", i/3600%24, i/60%60, i%60)
+		lines[i] = fmt.Sprintf(`%s - - [%s] "%s %s HTTP/1.1" %s %d "https://example.com/" "%s"`,
+			ip, ts, methods[r.Intn(len(methods))], path, statuses[r.Intn(len(statuses))], r.Intn(10000), agents[r.Intn(len(agents))])
+	}
+	return lines
+}
+
+func TestSplitParseMatchesRegex(t *testing.T) {
+	la := NewLogAnalyzer()
+	r := rand.New(rand.NewSource(1))
+	chars := []byte("\" -\t0123GETPOSTgetpost/abHTP.[x\xc5\xbf")
+	lines := sampleLog(2000)
+	for i := 0; i < 50000; i++ {
+		l := []byte(lines[r.Intn(2000)])
+		for k := r.Intn(4); k > 0; k-- {
+			p := r.Intn(len(l))
+			switch r.Intn(3) {
+			case 0:
+				l[p] = chars[r.Intn(len(chars))]
+			case 1:
+				l = append(l[:p], l[p+1:]...)
+			default:
+				l = append(l[:p], append([]byte{chars[r.Intn(len(chars))]}, l[p:]...)...)
+			}
+		}
+		lines = append(lines, string(l))
+	}
+	for _, l := range lines {
+		e, ok := splitParse(l)
+		if !ok {
+			continue
+		}
+		m := la.logRegex.FindStringSubmatch(l)
+		if m == nil {
+			t.Fatalf("split parser accepted a line the regex rejects: %q", l)
+		}
+		want := []string{m[1], m[2], m[3], m[4], m[5], m[6], m[7], m[9], m[10]}
+		got := []string{e.IP, e.Ident, e.User, e.Method, e.Path, e.Protocol, e.StatusCode, e.Referer, e.UserAgent}
+		if !slicesEqual(got, want) || e.Bytes != parseBytes(m[8]) {
+			t.Fatalf("%q: split parser got %q and %d bytes, regex %q", l, got, e.Bytes, m[1:])
+		}
+	}
+}
+
+// slicesEqual reports whether a and b hold the same strings.
+func slicesEqual(a, b []string) bool {
+	return strings.Join(a, "\x00") == strings.Join(b, "\x00")
+}
+
+func BenchmarkAnalyzeLines(b *testing.B) {
+	lines := sampleLog(10000)
+	for _, bc := range []struct {
+		name string
+		fast bool
+	}{{"split", true}, {"regex", false}} {
+		b.Run(bc.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				la := NewLogAnalyzer()
+				la.fastParse = bc.fast
+				la.analyzeLines(lines)
+			}
+			b.ReportMetric(float64(len(lines)*b.N)/b.Elapsed().Seconds(), "lines/s")
+		})
+	}
+}
+
+// highCardinality returns the counts of n distinct keys with a long tail.
+func highCardinality(n int) map[string]int {
+	r := rand.New(rand.NewSource(1))
+	counts := make(map[string]int, n)
+	for i := 0; i < n; i++ {
+		counts[fmt.Sprintf("/item/%d", i)] = int(r.ExpFloat64() * 100)
+	}
+	return counts
+}
+
+func TestGetTopNMatchesFullSort(t *testing.T) {
+	counts := highCardinality(5000)
+	all := getTopN(counts, 0)
+	for _, n := range []int{1, 5, 100, 4999} {
+		if got := getTopN(counts, n); !itemsEqual(got, all[:n]) {
+			t.Errorf("top %d differs from the first %d of the full sort", n, n)
+		}
+	}
+}
+
+// itemsEqual reports whether a and b hold the same items in order.
+func itemsEqual(a, b []ResultItem) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func BenchmarkGetTopN(b *testing.B) {
+	counts := highCardinality(1000000)
+	b.Run("heap", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			getTopN(counts, 5)
+		}
+	})
+	b.Run("full-sort", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			_ = getTopN(counts, 0)[:5]
+		}
+	})
+}
+
+func TestTopTrackerFindsHeavyHitters(t *testing.T) {
+	tracker := newTopTracker(50)
+	for i := 0; i < 100000; i++ {
+		key := fmt.Sprintf("/rare/%d", i)
+		if i%10 == 0 {
+			key = fmt.Sprintf("/hot/%d", i/10%5)
+		}
+		tracker.add(key, 1)
+	}
+	top := getTopN(tracker.counts(), 5)
+	for i, item := range top {
+		if !strings.HasPrefix(item.Value, "/hot/") || item.Count < 2000 {
+			t.Errorf("top %d is %s with %d, want a /hot/ path with at least 2000", i+1, item.Value, item.Count)
+		}
+	}
+}
+
+func BenchmarkTopPaths(b *testing.B) {
+	r := rand.New(rand.NewSource(1))
+	keys := make([]string, 1000000)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("/item/%d", int(r.ExpFloat64()*200000))
+	}
+	b.Run("tracker", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			tracker := newTopTracker(1000)
+			for _, k := range keys {
+				tracker.add(k, 1)
+			}
+			getTopN(tracker.counts(), 5)
+		}
+	})
+	b.Run("full-map", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			counts := make(map[string]int)
+			for _, k := range keys {
+				counts[k]++
+			}
+			getTopN(counts, 5)
+		}
+	})
+}
+
+func TestReorderedFields(t *testing.T) {
+	r := regexp.MustCompile(`^\[(?P<time>[^\]]+)\] (?P<status>\d{3}) (?P<bytes>\S+) (?P<method>\S+) (?P<path>\S+) from (?P<ip>\S+) "(?P<agent>[^"]*)"$`)
+	la := NewLogAnalyzer(WithRegex(r))
+	if err := la.Err(); err != nil {
+		t.Fatal(err)
+	}
+	entry, _, ok := la.parseLine(`[10/Oct/2023:13:55:36 +0000] 404 1234 POST /login from 192.0.2.7 "curl/8.4.0"`)
+	if !ok {
+		t.Fatal("reordered line did not parse")
+	}
+	want := LogEntry{IP: "192.0.2.7", Method: "POST", Path: "/login", StatusCode: "404", Bytes: 1234, UserAgent: "curl/8.4.0", Duration: -1}
+	got := entry
+	got.Timestamp = time.Time{}
+	if got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	if entry.Timestamp.Format(timestampLayout) != "10/Oct/2023:13:55:36 +0000" {
+		t.Errorf("timestamp %s", entry.Timestamp)
+	}
+}
+
+func TestPlaceholderFields(t *testing.T) {
+	lines := []string{
+		`1.2.3.4 - - [10/Oct/2023:13:55:36 +0000] "GET /a HTTP/1.1" 200 - "-" "-"`,
+		`1.2.3.4 - - [10/Oct/2023:13:55:36 +0000] "GET /a HTTP/1.1" 200 10 "https://example.com/" "curl/8.4.0"`,
+	}
+	la := NewLogAnalyzer()
+	la.analyzeLines(lines)
+	if la.agentCounts[noneKey] != 1 || la.refererCounts[noneKey] != 1 || la.sizeBucketCounts[noneKey] != 1 {
+		t.Errorf("placeholders: agents %v, referers %v, sizes %v, want one %s each", la.agentCounts, la.refererCounts, la.sizeBucketCounts, noneKey)
+	}
+	if _, ok := la.agentCounts["-"]; ok {
+		t.Error(`"-" counted as a user agent`)
+	}
+
+	la = NewLogAnalyzer()
+	la.dropEmpty = true
+	la.analyzeLines(lines)
+	if len(la.agentCounts) != 1 || len(la.refererCounts) != 1 || len(la.sizeBucketCounts) != 1 {
+		t.Errorf("-drop-empty: agents %v, referers %v, sizes %v, want only the real values", la.agentCounts, la.refererCounts, la.sizeBucketCounts)
+	}
+	if la.totalRequests() != 2 {
+		t.Errorf("-drop-empty: %d requests, want 2", la.totalRequests())
+	}
+}
+
+func TestMerge(t *testing.T) {
+	lines := sampleLog(3000)
+	whole := NewLogAnalyzer()
+	whole.analyzeLines(lines)
+	a, b := NewLogAnalyzer(), NewLogAnalyzer()
+	a.analyzeLines(lines[:1000])
+	b.analyzeLines(lines[1000:])
+	a.Merge(b)
+	for _, m := range []struct {
+		name      string
+		got, want map[string]int
+	}{
+		{"ips", a.ipCounts, whole.ipCounts},
+		{"paths", a.pathCounts, whole.pathCounts},
+		{"status", a.statusCounts, whole.statusCounts},
+		{"agents", a.agentCounts, whole.agentCounts},
+		{"methods", a.methodCounts, whole.methodCounts},
+	} {
+		if !maps.Equal(m.got, m.want) {
+			t.Errorf("merged %s differ from one analysis of every line", m.name)
+		}
+	}
+	if !maps.EqualFunc(a.statusPathCounts, whole.statusPathCounts, maps.Equal) {
+		t.Error("merged status path counts differ")
+	}
+	if !a.firstTime.Equal(whole.firstTime) || !a.lastTime.Equal(whole.lastTime) || a.lines != whole.lines {
+		t.Errorf("merged range %s to %s over %d lines, want %s to %s over %d", a.firstTime, a.lastTime, a.lines, whole.firstTime, whole.lastTime, whole.lines)
+	}
+}
+
+func TestStatusClass(t *testing.T) {
+	for code, want := range map[string]string{
+		"200": "2xx",
+		"404": "4xx",
+		"499": nonstandardClass,
+		"444": nonstandardClass,
+		"000": nonstandardClass,
+		"503": "5xx",
+		"-":   "",
+		"":    "",
+	} {
+		if got := statusClass(code); got != want {
+			t.Errorf("statusClass(%q) = %q, want %q", code, got, want)
+		}
+	}
+}
+
+func TestStatusFamily(t *testing.T) {
+	for code, want := range map[string]string{
+		"404": "4xx",
+		"499": nonstandardClass,
+		"-":   "-",
+	} {
+		if got := statusFamily(code); got != want {
+			t.Errorf("statusFamily(%q) = %q, want %q", code, got, want)
+		}
+	}
+}
+
+func TestLowercaseMethods(t *testing.T) {
+	for _, fast := range []bool{true, false} {
+		la := NewLogAnalyzer()
+		la.fastParse = fast
+		la.analyzeLines([]string{
+			`1.2.3.4 - - [10/Oct/2023:13:55:36 +0000] "get /x HTTP/1.1" 200 5 "-" "curl"`,
+			`1.2.3.4 - - [10/Oct/2023:13:55:36 +0000] "Post /x HTTP/1.1" 200 5`,
+		})
+		if la.skipped != 0 || la.pathCounts["/x"] != 2 || la.methodCounts["GET"] != 1 || la.methodCounts["POST"] != 1 {
+			t.Errorf("fast parser %v: skipped %d, paths %v, methods %v", fast, la.skipped, la.pathCounts, la.methodCounts)
+		}
+	}
+	// "ſ" folds to "s" in Unicode but is not a method letter.
+	if _, ok := splitParse(`1.2.3.4 - - [x] "POſT /x HTTP/1.1" 200 5 "-" "a"`); ok {
+		t.Error("split parser accepted a non-ASCII method")
+	}
+}
+
+func TestCRLFLines(t *testing.T) {
+	lf := sampleLog(500)
+	crlf := make([]string, len(lf))
+	for i, l := range lf {
+		crlf[i] = l + "\r"
+	}
+	crlf = append(crlf, " \r")
+	custom := regexp.MustCompile(`^(?P<ip>\S+) \S+ \S+ \[[^\]]*\] "\S+ (?P<path>\S+)[^"]*" (?P<status>\d+) \S+ "[^"]*" "(?P<agent>.*)$`)
+	for _, opts := range [][]Option{nil, {WithRegex(custom)}} {
+		a, c := NewLogAnalyzer(opts...), NewLogAnalyzer(opts...)
+		a.analyzeLines(lf)
+		c.analyzeLines(crlf)
+		if !maps.Equal(a.agentCounts, c.agentCounts) || !maps.Equal(a.pathCounts, c.pathCounts) || a.skipped != c.skipped || a.lines != c.lines {
+			t.Errorf("CRLF lines differ from LF: skipped %d/%d, lines %d/%d, agents %d/%d", a.skipped, c.skipped, a.lines, c.lines, len(a.agentCounts), len(c.agentCounts))
+		}
+	}
+}
+
+func TestAnalyze(t *testing.T) {
+	out := captureStdout(t, func() {
+		report, err := Analyze(strings.NewReader(`1.2.3.4 - - [10/Oct/2023:13:55:36 +0000] "GET /x HTTP/1.1" 200 5 "-" "curl"
+1.2.3.5 - - [10/Oct/2023:13:55:36 +0000] "GET /x HTTP/1.1" 500 5 "-" "curl"
+garbage
+`), WithTopN(1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if report.TotalRequests != 2 || report.UniqueIPs != 2 || report.TotalLines != 3 || report.SkippedLines != 1 || report.StatusClasses["5xx"] != 1 {
+			t.Errorf("unexpected totals: %+v", report)
+		}
+		if ips := report.Categories["ips"].Items; len(ips) != 1 {
+			t.Errorf("got %d IPs, want the top 1", len(ips))
+		}
+		if paths := report.Categories["paths"].Items; len(paths) != 1 || paths[0].Value != "/x" || paths[0].Count != 2 {
+			t.Errorf("paths %+v, want /x with 2", paths)
+		}
+	})
+	if out != "" {
+		t.Errorf("Analyze printed %q", out)
+	}
+	if _, err := Analyze(strings.NewReader(""), WithTopN(-1)); err == nil {
+		t.Error("negative top N accepted")
+	}
+	if _, err := Analyze(strings.NewReader(""), WithRegex(regexp.MustCompile(`x`))); err == nil {
+		t.Error("regex without the required groups accepted")
+	}
+}
+
+// resultsFixture is the Results the reporter golden tests render.
+func resultsFixture() Results {
+	return Results{
+		Categories: []CategoryResults{
+			{Name: "ips", Label: "ip", Title: "Top 2 IP addresses with the most requests", Total: 10, BelowMin: 3,
+				Items: []ResultItem{{Value: "10.0.0.1", Count: 6, Percent: 60}, {Value: "10.0.0.2", Count: 4, Percent: 40}}},
+			{Name: "paths", Label: "path", Title: "Top 2 most requested paths", Total: 10,
+				Items: []ResultItem{{Value: "/", Count: 7, Percent: 70}, {Value: "/search?q=a,b c", Count: 3, Percent: 30}}},
+			{Name: "status", Label: "status", Title: "Top 2 response status codes", Total: 10,
+				Items: []ResultItem{{Value: "200", Count: 8, Percent: 80}, {Value: "503", Count: 2, Percent: 20}}},
+			{Name: "agents", Label: "agent", Title: "Top 2 user agents", Total: 10,
+				Items: []ResultItem{{Value: `Mozilla/5.0 "quoted" <tag> & more`, Count: 10, Percent: 100}}},
+		},
+		TotalRequests:  10,
+		UniqueIPs:      2,
+		UniquePaths:    2,
+		StatusClasses:  map[string]int{"2xx": 8, "5xx": 2},
+		Summary:        summary{TotalRequests: 10, UniqueIPs: 2, UniquePaths: 2, ServerErrorPct: 20, TopPath: "/", TopIP: "10.0.0.1"},
+		Sources:        []string{"access.log", "archive.tar#b.log"},
+		TotalLines:     12,
+		SkippedLines:   1,
+		MalformedLines: 1,
+	}
+}
+
+// runTimes matches the run timestamps of the Prometheus, Influx and
+// json-full outputs, which the golden files cannot fix.
+var runTimes = regexp.MustCompile(`(?m)(log_analyzer_last_run_timestamp_seconds| count=\d+i| requests=\S+|"analyzed_at":) "?\d[\dTZ:.+-]{9,}"?(,?)$`)
+
+func TestReporterGolden(t *testing.T) {
+	tmpl := template.Must(template.New("t").Funcs(templateFuncs).Parse(
+		`{{formatInt .TotalRequests}} requests{{range (.Category "paths").Items}}
+{{.Value}} {{formatInt .Count}} {{formatPercent .Percent}}{{end}}
+`))
+	for _, tc := range []struct {
+		name     string
+		reporter Reporter
+	}{
+		{"text", TextReporter{}},
+		{"json", JSONReporter{}},
+		{"json-full", JSONFullReporter{}},
+		{"csv", CSVReporter{}},
+		{"ndjson", NDJSONReporter{}},
+		{"xml", XMLReporter{}},
+		{"prometheus-textfile", PrometheusReporter{}},
+		{"template", TemplateReporter{Template: tmpl}},
+		{"influx", InfluxReporter{Paths: true, IPs: true}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var b bytes.Buffer
+			if err := tc.reporter.Report(&b, resultsFixture()); err != nil {
+				t.Fatal(err)
+			}
+			checkGolden(t, tc.name, b.String())
+		})
+	}
+}
+
+func TestSummaryReporterGolden(t *testing.T) {
+	results := resultsFixture()
+	results.RealSummary = &summary{TotalRequests: 7, UniqueIPs: 1, UniquePaths: 2, ServerErrorPct: 0, TopPath: "/search?q=a,b c", TopIP: "10.0.0.2"}
+	for _, tc := range []struct {
+		name     string
+		reporter SummaryReporter
+	}{
+		{"text", TextReporter{}},
+		{"json", JSONReporter{}},
+		{"json-full", JSONFullReporter{}},
+		{"csv", CSVReporter{}},
+		{"ndjson", NDJSONReporter{}},
+		{"xml", XMLReporter{}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var b bytes.Buffer
+			if err := tc.reporter.ReportSummary(&b, results); err != nil {
+				t.Fatal(err)
+			}
+			checkGolden(t, tc.name+"-summary", b.String())
+		})
+	}
+}
+
+// checkGolden compares output, with runTimes masked, to
+// testdata/name.golden, rewriting the file first with -update.
+func checkGolden(t *testing.T, name, output string) {
+	t.Helper()
+	got := runTimes.ReplaceAllString(output, "$1 TIME$2")
+	golden := filepath.Join("testdata", name+".golden")
+	if *update {
+		if err := os.WriteFile(golden, []byte(got), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := os.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != string(want) {
+		t.Errorf("output differs from %s (go test -update rewrites it):\n%s", golden, got)
+	}
+}
+
+func TestCrossReportsWithApproxTop(t *testing.T) {
+	la := NewLogAnalyzer()
+	la.useTopTrackers(2)
+	var lines []string
+	for i := 0; i < 20; i++ {
+		lines = append(lines, combinedLine("10.0.0.1", "10/Oct/2023:13:55:36 +0000", "/hot", "200"))
+	}
+	for i := 0; i < 20; i++ {
+		lines = append(lines, combinedLine(fmt.Sprintf("10.0.1.%d", i), "10/Oct/2023:13:55:36 +0000", fmt.Sprintf("/rare/%d", i), "401"))
+	}
+	la.analyzeLines(lines)
+	for _, ps := range la.importanceScores(2) {
+		if ps.Requests == 0 || ps.Score != ps.Score {
+			t.Errorf("scored %s with %d requests: %v", ps.Path, ps.Requests, ps.Score)
+		}
+	}
+	out := captureStdout(t, func() { la.printAuthFailures(5, 1) })
+	if strings.Contains(out, "of 0 requests") || !strings.Contains(out, "requests not tracked") {
+		t.Errorf("auth failures of untracked IPs:\n%s", out)
+	}
+}
+
+func TestApplyConfig(t *testing.T) {
+	defer func(fs *flag.FlagSet) { flag.CommandLine = fs }(flag.CommandLine)
+	flag.CommandLine = flag.NewFlagSet("test", flag.ContinueOnError)
+	var urls stringList
+	flag.Var(&urls, "url", "")
+	top := flag.Int("top", 5, "")
+	status := flag.String("include-status", "", "")
+	anonymize := flag.Bool("anonymize-ip", false, "")
+	flag.String("config", "", "")
+	if err := flag.CommandLine.Parse([]string{"-top", "3"}); err != nil {
+		t.Fatal(err)
+	}
+
+	name := filepath.Join(t.TempDir(), "config.json")
+	write := func(s string) {
+		if err := os.WriteFile(name, []byte(s), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(`{"url": ["a.log", "b.log"], "top": 10, "include-status": "4xx", "anonymize-ip": true}`)
+	if err := applyConfig(name); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(urls, ",") != "a.log,b.log" || *top != 3 || *status != "4xx" || !*anonymize {
+		t.Errorf("got url %q, top %d, include-status %q, anonymize-ip %v", urls, *top, *status, *anonymize)
+	}
+	for _, bad := range []string{`{"nope": 1}`, `{"config": "x.json"}`, `{"include-status": null}`, `{"url": [["a"]]}`, `[1]`} {
+		write(bad)
+		if err := applyConfig(name); err == nil {
+			t.Errorf("config %s accepted", bad)
+		}
+	}
+}
+
+func TestSkipSamplesAnonymized(t *testing.T) {
+	la := NewLogAnalyzer()
+	la.anonymizeIPs = true
+	la.maxSkipSamples = 10
+	lines := []string{
+		"garbage from 203.0.113.77 at 10/Oct/2023:13:55:36",
+		"bad 2001:db8:1234:5678::1 line",
+	}
+	la.analyzeLines(lines)
+	var out bytes.Buffer
+	la.printSkipped(&out)
+	got := out.String()
+	for _, leak := range []string{"203.0.113.77", "2001:db8:1234:5678::1"} {
+		if strings.Contains(got, leak) {
+			t.Errorf("skip samples leak %s:\n%s", leak, got)
+		}
+	}
+	for _, want := range []string{"203.0.113.0", "2001:db8:1234::", "10/Oct/2023:13:55:36"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("skip samples miss %s:\n%s", want, got)
+		}
+	}
+}
+
+func TestFilterOptions(t *testing.T) {
+	logs := strings.Join([]string{
+		combinedLine("203.0.113.7", "10/Oct/2023:13:55:36 +0000", "/a", "200"),
+		combinedLine("203.0.113.8", "10/Oct/2023:13:55:36 +0000", "/A//b", "404"),
+		combinedLine("203.0.113.9", "10/Oct/2023:13:55:36 +0000", "/health", "503"),
+		combinedLine("198.51.100.1", "10/Oct/2023:13:55:36 +0000", "/a", "500"),
+	}, "\n")
+	report, err := Analyze(strings.NewReader(logs),
+		WithIncludeStatus("2xx,4xx,5xx"),
+		WithExcludeStatus("500"),
+		WithStatusRegex(regexp.MustCompile(`^[245]`)),
+		WithAnonymizeIPs(),
+		WithFoldCase(true, false),
+		WithCleanPaths(),
+		WithNormalizeStatus(),
+		WithOnly("ips", "paths", "status"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.TotalRequests != 3 || report.UniqueIPs != 1 {
+		t.Errorf("got %d requests from %d IPs, want 3 from 1", report.TotalRequests, report.UniqueIPs)
+	}
+	if _, ok := report.Categories["agents"]; ok {
+		t.Error("agents reported despite WithOnly")
+	}
+	want := map[string]int{"/a": 1, "/a/b": 1, "/health": 1}
+	for _, item := range report.Categories["paths"].Items {
+		if want[item.Value] != item.Count {
+			t.Errorf("path %s counted %d times", item.Value, item.Count)
+		}
+	}
+	if ips := report.Categories["ips"].Items; len(ips) != 1 || ips[0].Value != "203.0.113.0" {
+		t.Errorf("ips %+v, want 203.0.113.0", ips)
+	}
+	if status := report.Categories["status"].Items; len(status) != 3 || status[0].Value[1:] != "xx" {
+		t.Errorf("status %+v, want classes", status)
+	}
+
+	for name, opt := range map[string]Option{
+		"include status":  WithIncludeStatus("4yy"),
+		"exclude status":  WithExcludeStatus("x"),
+		"monitor IPs":     WithMonitorIPs("bad"),
+		"IP whitelist":    WithIPWhitelist("10.0.0.0/99"),
+		"only":            WithOnly("nope"),
+		"max cardinality": WithMaxCardinality(-1),
+		"approx top":      WithApproxTop(0),
+	} {
+		if _, err := Analyze(strings.NewReader(logs), opt); err == nil {
+			t.Errorf("invalid %s accepted", name)
+		}
+	}
+}
+
+func TestAnalyzeReaderChunks(t *testing.T) {
+	lines := sampleLog(3*analyzeChunk + 17)
+	lines[2*analyzeChunk+5] = "garbage"
+	want := NewLogAnalyzer()
+	want.analyzeLines(slices.Clone(lines))
+
+	report, err := Analyze(strings.NewReader(strings.Join(lines, "\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.TotalLines != want.lines || report.SkippedLines != 1 || report.TotalRequests != want.totalRequests() {
+		t.Errorf("got %d lines, %d skipped, %d requests, want %d, 1, %d",
+			report.TotalLines, report.SkippedLines, report.TotalRequests, want.lines, want.totalRequests())
+	}
+
+	la := NewLogAnalyzer()
+	la.maxSkipSamples = 1
+	if err := la.analyzeReader(strings.NewReader(strings.Join(lines, "\n"))); err != nil {
+		t.Fatal(err)
+	}
+	if s := la.skipSamples; len(s) != 1 || s[0].number != 2*analyzeChunk+6 {
+		t.Errorf("skip samples %+v, want line %d", s, 2*analyzeChunk+6)
+	}
+	if !maps.Equal(la.pathCounts, want.pathCounts) {
+		t.Error("path counts differ from a single analyzeLines call")
+	}
+}
+
+func TestAnalyzeReaderJoinsAcrossChunks(t *testing.T) {
+	lines := sampleLog(analyzeChunk)
+	lines = append(lines, "  at frame one", "  at frame two", combinedLine("10.0.0.1", "10/Oct/2023:13:55:36 +0000", "/x", "200"))
+	la := NewLogAnalyzer()
+	la.joinContinuations = true
+	la.maxSkipSamples = 1
+	if err := la.analyzeReader(strings.NewReader(strings.Join(lines, "\n"))); err != nil {
+		t.Fatal(err)
+	}
+	if la.skipped != 0 || la.lines != analyzeChunk+1 {
+		t.Errorf("got %d lines, %d skipped (%+v), want %d and none", la.lines, la.skipped, la.skipSamples, analyzeChunk+1)
+	}
+}
+
+func TestWhitelistSkipsScannerHeuristic(t *testing.T) {
+	la := NewLogAnalyzer(WithIPWhitelist("10.0.0.0/24"))
+	la.trackIPPaths = true
+	var lines []string
+	for _, ip := range []string{"10.0.0.5", "203.0.113.9"} {
+		for i := 0; i < 30; i++ {
+			lines = append(lines, combinedLine(ip, "10/Oct/2023:13:55:36 +0000", fmt.Sprintf("/probe/%d", i), "404"))
+		}
+	}
+	la.analyzeLines(lines)
+	out := captureStdout(t, func() { la.printUniquePathsPerIP(5, 20) })
+	if strings.Contains(out, "10.0.0.5") {
+		t.Errorf("whitelisted IP reported:\n%s", out)
+	}
+	if !strings.Contains(out, "203.0.113.9") || !strings.Contains(out, "possible scanner") {
+		t.Errorf("scanner not flagged:\n%s", out)
+	}
+}
+
+func TestWhitelistSkipsRotatingAgents(t *testing.T) {
+	la := NewLogAnalyzer(WithIPWhitelist("10.0.0.5"))
+	la.trackIPAgents = true
+	var lines []string
+	for _, ip := range []string{"10.0.0.5", "203.0.113.9"} {
+		for i := 0; i < 10; i++ {
+			lines = append(lines, fmt.Sprintf(`%s - - [10/Oct/2023:13:55:36 +0000] "GET / HTTP/1.1" 200 512 "-" "bot/%d"`, ip, i))
+		}
+	}
+	la.analyzeLines(lines)
+	out := captureStdout(t, func() { la.printAgentsPerIP(5, 3) })
+	if strings.Contains(out, "10.0.0.5") {
+		t.Errorf("whitelisted IP reported:\n%s", out)
+	}
+	if !strings.Contains(out, "203.0.113.9") || !strings.Contains(out, "rotating agents") {
+		t.Errorf("rotating agents not flagged:\n%s", out)
+	}
+}
+
+func TestLatencyConcurrentReports(t *testing.T) {
+	la := NewLogAnalyzer(WithRegex(regexp.MustCompile(`^(?P<ip>\S+) (?P<method>\S+) (?P<path>\S+) (?P<status>\d+) (?P<duration>\d+)$`)))
+	la.trackLatency = true
+	timed := func(seed int) []string {
+		r := rand.New(rand.NewSource(int64(seed)))
+		lines := make([]string, 500)
+		for i := range lines {
+			lines[i] = fmt.Sprintf("10.0.0.%d GET /p%d 200 %d", i%7, i%3, r.Intn(100000))
+		}
+		return lines
+	}
+	la.analyzeLines(timed(0))
+	before := slices.Clone(la.pathDurations["/p0"])
+
+	// Run with go test -race: reports share the read lock, so they must
+	// not reorder the durations analyzeLines appends to.
+	captureStdout(t, func() {
+		var wg sync.WaitGroup
+		for i := 1; i <= 4; i++ {
+			wg.Add(2)
+			go func() {
+				defer wg.Done()
+				la.printReports(options{showLatency: true})
+			}()
+			go func() {
+				defer wg.Done()
+				la.analyzeLines(timed(i))
+			}()
+		}
+		wg.Wait()
+	})
+	if got := la.pathDurations["/p0"][:len(before)]; !slices.Equal(got, before) {
+		t.Error("reporting reordered the stored durations")
+	}
+}
+
+func TestDurationsOnlyWithLatency(t *testing.T) {
+	r := regexp.MustCompile(`^(?P<ip>\S+) (?P<method>\S+) (?P<path>\S+) (?P<status>\d+) (?P<duration>\d+)$`)
+	for _, track := range []bool{false, true} {
+		la := NewLogAnalyzer(WithRegex(r))
+		la.trackLatency = track
+		la.analyzeLines([]string{"10.0.0.1 GET /a 200 1500", "10.0.0.1 GET /a 200 2500"})
+		if got := len(la.pathDurations["/a"]); got != map[bool]int{false: 0, true: 2}[track] {
+			t.Errorf("trackLatency %v: stored %d durations", track, got)
+		}
+	}
+}
+
+func TestMatchedCountsFilteredLines(t *testing.T) {
+	la := NewLogAnalyzer(WithIncludeStatus("302"))
+	la.analyzeLines([]string{
+		combinedLine("10.0.0.1", "10/Oct/2023:13:55:36 +0000", "/a", "200"),
+		combinedLine("10.0.0.2", "10/Oct/2023:13:55:36 +0000", "/b", "404"),
+		"garbage",
+	})
+	if la.lines != 3 || la.matched != 2 || la.totalRequests() != 0 || la.statusFiltered != 2 {
+		t.Errorf("got %d lines, %d matched, %d requests, %d filtered, want 3, 2, 0, 2", la.lines, la.matched, la.totalRequests(), la.statusFiltered)
+	}
+}
+
+func TestChartPNG(t *testing.T) {
+	la := NewLogAnalyzer()
+	la.analyzeLines([]string{
+		combinedLine("10.0.0.1", "10/Oct/2023:13:55:36 +0000", "/a", "200"),
+		combinedLine("10.0.0.1", "10/Oct/2023:13:55:36 +0000", "/b", "404"),
+	})
+	var b bytes.Buffer
+	if err := writeChartPNG(&b, la.categories(), 5); err != nil {
+		t.Fatal(err)
+	}
+	img, err := png.Decode(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows, height := chartLayout(la.categories(), 5)
+	if got := img.Bounds().Size(); got != image.Pt(chartWidth, height) {
+		t.Errorf("image is %v, want %dx%d", got, chartWidth, height)
+	}
+	for _, row := range rows {
+		if row.title != "" || row.note != "" {
+			continue
+		}
+		if got := color.RGBAModel.Convert(img.At(chartLabelWidth, row.y+chartBarHeight/2)); got != chartBarColor {
+			t.Errorf("bar of %s has color %v, want %v", row.item.Value, got, chartBarColor)
+		}
+		if got := color.RGBAModel.Convert(img.At(chartLabelWidth+row.barWidth+1, row.y)); got != (color.RGBA{0xff, 0xff, 0xff, 0xff}) {
+			t.Errorf("bar of %s is wider than %d", row.item.Value, row.barWidth)
+		}
+	}
+}
+
+// parseArgs runs parseOptions on args with a fresh flag set.
+func parseArgs(t *testing.T, args ...string) (options, error) {
+	t.Helper()
+	defer func(fs *flag.FlagSet, osArgs []string) { flag.CommandLine, os.Args = fs, osArgs }(flag.CommandLine, os.Args)
+	flag.CommandLine = flag.NewFlagSet("log_analyzer", flag.ContinueOnError)
+	os.Args = append([]string{"log_analyzer"}, args...)
+	return parseOptions()
+}
+
+func TestExplorerOrdersTiesByValue(t *testing.T) {
+	la := NewLogAnalyzer()
+	la.analyzeLines([]string{
+		combinedLine("1.2.3.4", "10/Oct/2023:13:55:36 -0700", "/c", "200"),
+		combinedLine("1.2.3.4", "10/Oct/2023:13:55:36 -0700", "/a", "200"),
+		combinedLine("1.2.3.4", "10/Oct/2023:13:55:36 -0700", "/b", "200"),
+		combinedLine("1.2.3.4", "10/Oct/2023:13:55:36 -0700", "/b", "200"),
+	})
+	var out strings.Builder
+	runExplorer(strings.NewReader("paths\n"), &out, la)
+	want := "  /b - 2 requests\n  /a - 1 requests\n  /c - 1 requests\n"
+	if !strings.Contains(out.String(), "paths, 3 rows by count:\n"+want) {
+		t.Errorf("explorer output does not list the paths as\n%s\ngot:\n%s", want, out.String())
+	}
+}
+
+func TestTUIRejectsOtherStdoutReports(t *testing.T) {
+	for _, args := range [][]string{{"-compact"}, {"-summary-only"}, {"-format", "json"}, {"-emit-entries", "-"}} {
+		if _, err := parseArgs(t, append([]string{"-tui"}, args...)...); err == nil {
+			t.Errorf("-tui %s: want an error", strings.Join(args, " "))
+		}
+	}
+	if _, err := parseArgs(t, "-tui", "-fail-on-5xx-pct", "1", "-chart", "out.svg"); err != nil {
+		t.Errorf("-tui with alerts and charts: %v", err)
+	}
+}
+
+func TestFailOnErrorIncreaseNeedsBaseline(t *testing.T) {
+	if _, err := parseArgs(t, "-fail-on-error-increase", "5"); err == nil || !strings.Contains(err.Error(), "needs -baseline") {
+		t.Errorf("-fail-on-error-increase without -baseline: got error %v", err)
+	}
+	if _, err := parseArgs(t, "-fail-on-error-increase", "5", "-baseline", "before.json"); err != nil {
+		t.Errorf("-fail-on-error-increase with -baseline: %v", err)
+	}
+}